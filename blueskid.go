@@ -6,27 +6,151 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 // contains a web server which exhibits blueskid exercising parts of the "@bluesky identity" protocol.
 
 func main() {
 	port := flag.Int("port", 8123, "port number")
+	reservation := flag.Duration("reservation", blueskidgo.ReservationTime, "how long an allocated BID is reserved")
+	workers := flag.Int("workers", 4, "number of background submission verifiers")
+	replicaOf := flag.String("replica-of", "", "URL of the primary server; if set, this server is a read-only replica of its ledger")
+	clusterID := flag.String("cluster-id", "", "this server's public URL; if set, the ledger is kept by a Raft cluster")
+	clusterPeers := flag.String("cluster-peers", "", "comma-separated url=host:port for each cluster server, this one included")
+	clusterDir := flag.String("cluster-dir", "raft", "directory for the Raft log and snapshots")
+	ledgerDB := flag.String("ledger-db", "", "SQLite file in which to keep the ledger; if not set, it's only in memory")
+	importFile := flag.String("import", "", "ledger export to load, in JSON Lines or CBOR, into an empty ledger at startup")
+	journal := flag.String("submission-journal", "", "file in which to persist submissions")
+	reverifyInterval := flag.Duration("reverify-interval", 24*time.Hour, "how often to re-fetch ledger posts, 0 to never")
+	reverifyPolicy := flag.String("reverify-policy", "flag", "what to do about broken posts: 'flag' or 'unclaim'")
+	bidReuse := flag.String("bid-reuse", "never", "whether a BID can be claimed again once its last PID has left: 'never', 'always', or after a duration")
+	fetchCache := flag.Int("fetch-cache", blueskidgo.FetchCacheSize, "how many fetched posts to cache")
+	fetchTimeout := flag.Duration("fetch-timeout", blueskidgo.DefaultFetchLimits.Timeout, "how long to wait for a provider to return a post")
+	var hooks webhookURLs
+	flag.Var(&hooks, "webhook", "URL to POST ledger appends to, may be repeated; secret is in BLUESKID_WEBHOOK_SECRET")
+	flag.Parse()
+	blueskidgo.ReservationTime = *reservation
+	reuse, err := blueskidgo.ParseBIDReusePolicy(*bidReuse)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	blueskidgo.BIDReuse = reuse
+	blueskidgo.FetchCacheSize = *fetchCache
+	blueskidgo.DefaultFetchLimits.Timeout = *fetchTimeout
 	portArg := fmt.Sprintf(":%d", *port)
 
+	if *ledgerDB != "" {
+		err := blueskidgo.OpenLedgerDB(*ledgerDB)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *importFile != "" {
+		if *replicaOf != "" || *clusterID != "" {
+			log.Fatalln("--import can't be combined with --replica-of or --cluster-id")
+		}
+		f, err := os.Open(*importFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		count, err := blueskidgo.ImportLedger(f)
+		_ = f.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("imported %d ledger records from %s", count, *importFile)
+	}
+	if *journal != "" {
+		err := blueskidgo.OpenSubmissionJournal(*journal)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for _, hook := range hooks {
+		blueskidgo.AddWebhook(hook, os.Getenv("BLUESKID_WEBHOOK_SECRET"))
+	}
+	// a replica's ledger only changes when the primary's does, and in a cluster only the leader can change it
+	var replica *blueskidgo.Replica
+	primaryOnly := func(handler http.HandlerFunc) http.HandlerFunc { return handler }
+	if *clusterID != "" {
+		if *replicaOf != "" || *ledgerDB != "" {
+			log.Fatalln("--cluster-id can't be combined with --replica-of or --ledger-db")
+		}
+		peers, err := blueskidgo.ParseClusterPeers(*clusterPeers)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cluster, err := blueskidgo.StartCluster(*clusterID, peers, *clusterDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		primaryOnly = cluster.LeaderOnly
+	} else if *replicaOf != "" {
+		replica = blueskidgo.NewReplica(*replicaOf)
+		replica.Start()
+		primaryOnly = func(http.HandlerFunc) http.HandlerFunc { return replica.RedirectToPrimary }
+	}
+
+	blueskidgo.StartVerifiers(*workers)
+	if *reverifyInterval > 0 && replica == nil {
+		policy, err := blueskidgo.ParseReverifyPolicy(*reverifyPolicy)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		blueskidgo.StartReverifier(*reverifyInterval, policy)
+	}
+
 	http.HandleFunc("/grant-assertions", blueskidgo.GrantAssertionsHandler)
+	http.HandleFunc("/transfer-assertions", blueskidgo.TransferAssertionsHandler)
 	http.HandleFunc("/claim-assertion", blueskidgo.ClaimAssertionsHandler)
 	http.HandleFunc("/unclaim-assertion", blueskidgo.UnclaimAssertionsHandler)
-	http.HandleFunc("/claim-bid", blueskidgo.ClaimBIDHandler)
-	http.HandleFunc("/grant-bid", blueskidgo.GrantBIDHandler)
-	http.HandleFunc("/unclaim-bid", blueskidgo.UnclaimBIDHandler)
+	http.HandleFunc("/revoke-assertion", blueskidgo.RevokeAssertionHandler)
+	http.HandleFunc("/remove-assertion", blueskidgo.RemoveAssertionHandler)
+	http.HandleFunc("/policy-assertion", blueskidgo.PolicyAssertionHandler)
+	http.HandleFunc("/approval-assertion", blueskidgo.ApprovalAssertionHandler)
+	http.HandleFunc("/allocate-bid", primaryOnly(blueskidgo.AllocateBIDHandler))
+	http.HandleFunc("/claim-bid", primaryOnly(blueskidgo.ClaimBIDHandler))
+	http.HandleFunc("/grant-bid", primaryOnly(blueskidgo.GrantBIDHandler))
+	http.HandleFunc("/verify-claim", primaryOnly(blueskidgo.VerifyClaimHandler))
+	http.HandleFunc("/verify-grant", primaryOnly(blueskidgo.VerifyGrantHandler))
+	http.HandleFunc("/verify-claim-text", blueskidgo.VerifyClaimTextHandler)
+	http.HandleFunc("/verify-grant-text", blueskidgo.VerifyGrantTextHandler)
+	http.HandleFunc("/transfer-bid", primaryOnly(blueskidgo.TransferBIDHandler))
+	http.HandleFunc("/unclaim-bid", primaryOnly(blueskidgo.UnclaimBIDHandler))
+	http.HandleFunc("/revoke-key", primaryOnly(blueskidgo.RevokeKeyHandler))
+	http.HandleFunc("/remove-pid", primaryOnly(blueskidgo.RemovePIDHandler))
+	http.HandleFunc("/set-policy", primaryOnly(blueskidgo.SetPolicyHandler))
+	http.HandleFunc("/approve", primaryOnly(blueskidgo.ApproveHandler))
+	http.HandleFunc("/pending-approvals", primaryOnly(blueskidgo.PendingApprovalsHandler))
+	http.HandleFunc("/submissions/", primaryOnly(blueskidgo.SubmissionHandler))
 	http.HandleFunc("/pid-group", blueskidgo.GetPIDGroupHandler)
+	http.HandleFunc("/pid-graph", blueskidgo.PIDGraphHandler)
 	http.HandleFunc("/pids-for-bid", blueskidgo.GetPIDsForBIDHandler)
+	http.HandleFunc("/bid-status", blueskidgo.BIDStatusHandler)
 	http.HandleFunc("/bids-for-pid", blueskidgo.GetBIDsforPIDHandler)
+	http.HandleFunc("/bid-history", blueskidgo.BIDHistoryHandler)
+	http.HandleFunc("/pid-history", blueskidgo.PIDHistoryHandler)
+	http.HandleFunc("/reverify-flags", primaryOnly(blueskidgo.ReverifyFlagsHandler))
 	http.HandleFunc("/ledger", blueskidgo.LedgerHandler)
+	http.HandleFunc("/ledger/stream", blueskidgo.LedgerStreamHandler)
+	http.HandleFunc("/ledger/export", blueskidgo.LedgerExportHandler)
 
-	err := http.ListenAndServe(portArg, nil)
+	err = http.ListenAndServe(portArg, nil)
 	if err != nil {
 		log.Fatalln(err)
 	}
 }
+
+type webhookURLs []string
+
+func (u *webhookURLs) String() string {
+	return strings.Join(*u, ",")
+}
+
+func (u *webhookURLs) Set(s string) error {
+	*u = append(*u, s)
+	return nil
+}
@@ -0,0 +1,129 @@
+package blueskidgo
+
+// hands out BIDs that aren't in use, so people don't have to make up their own and hope for the best
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ReservationTime is how long an allocated BID is held for the PID that requested it. During that time, only that
+// PID can claim it.
+var ReservationTime = 15 * time.Minute
+
+type reservation struct {
+	pid     string
+	expires time.Time
+}
+
+type allocateBIDRequest struct {
+	Requester string
+}
+type allocateBIDResponse struct {
+	BID           string
+	Assertion     string
+	ReservedFor   string `json:",omitempty"`
+	ReservedUntil string `json:",omitempty"`
+}
+
+// AllocateBIDHandler the request body is optional. If it's provided and has a Requester PID, the BID is reserved for
+// that PID for ReservationTime
+func AllocateBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if httpRequest.Method != "POST" {
+		http.Error(w, "Method is not supported.", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(httpRequest.Body)
+	if err != nil {
+		http.Error(w, "Can't read request body: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var req allocateBIDRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, "Can't parse JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	requester := ""
+	if req.Requester != "" {
+		requester, err = NormalizePID(req.Requester)
+		if err != nil {
+			http.Error(w, "Invalid Requester: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	bid, expires, err := storeFor(httpRequest).allocateBID(requester, time.Now())
+	if err != nil {
+		http.Error(w, "Can't allocate BID: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := allocateBIDResponse{BID: FormatBID(bid), Assertion: bidAssertion("C", bid)}
+	if requester != "" {
+		response.ReservedFor = requester
+		response.ReservedUntil = expires.UTC().Format(time.RFC3339)
+	}
+	respJSON, err := json.MarshalIndent(response, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// allocateBID picks random BIDs until it finds one that has never been claimed and isn't reserved. With 64 bits
+// to play with, the first try will basically always work.
+func (s *ledgerStore) allocateBID(requester string, now time.Time) (bid uint64, expires time.Time, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.expireReservations(now)
+
+	b := make([]byte, 8)
+	for tries := 0; tries < 10; tries++ {
+		_, err = rand.Read(b)
+		if err != nil {
+			return
+		}
+		bid = binary.BigEndian.Uint64(b)
+		if bid == 0 {
+			continue
+		}
+		bidString := FormatBID(bid)
+		_, claimed := s.mappings.PIDsForBID[bidString]
+		_, reserved := s.reservations[bidString]
+		if claimed || reserved {
+			continue
+		}
+		if requester != "" {
+			expires = now.Add(ReservationTime)
+			s.reservations[bidString] = reservation{pid: requester, expires: expires}
+		}
+		return
+	}
+	err = errors.New("couldn't find an unused BID")
+	return
+}
+
+// checkReservation must be called with the store locked
+func (s *ledgerStore) checkReservation(bid string, pid string, now time.Time) error {
+	r, ok := s.reservations[bid]
+	if !ok || now.After(r.expires) || r.pid == pid {
+		return nil
+	}
+	return errors.New("BID '" + bid + "' is reserved for another account")
+}
+
+// expireReservations must be called with the store locked
+func (s *ledgerStore) expireReservations(now time.Time) {
+	for bid, r := range s.reservations {
+		if now.After(r.expires) {
+			delete(s.reservations, bid)
+		}
+	}
+}
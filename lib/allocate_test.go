@@ -0,0 +1,101 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllocateBID(t *testing.T) {
+	now := time.Now()
+
+	// unreserved
+	bid, _, err := theStore.allocateBID("", now)
+	if err != nil {
+		t.Error("allocate: " + err.Error())
+	}
+	_, reserved := theStore.reservations[FormatBID(bid)]
+	if reserved {
+		t.Error("reserved a BID with no requester")
+	}
+
+	// reserved
+	bid, expires, err := theStore.allocateBID("twitter.com@reserver", now)
+	if err != nil {
+		t.Error("allocate: " + err.Error())
+	}
+	if !expires.Equal(now.Add(ReservationTime)) {
+		t.Error("wrong expiry")
+	}
+	bidString := FormatBID(bid)
+	err = theStore.checkReservation(bidString, "reddit.com@interloper", now)
+	if err == nil {
+		t.Error("reservation didn't block other PID")
+	}
+	err = theStore.checkReservation(bidString, "twitter.com@reserver", now)
+	if err != nil {
+		t.Error("reservation blocked requester: " + err.Error())
+	}
+	err = theStore.checkReservation(bidString, "reddit.com@interloper", expires.Add(time.Second))
+	if err != nil {
+		t.Error("expired reservation still blocking: " + err.Error())
+	}
+
+	// only the reserver gets to claim it
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bidString, PIDs: []string{"reddit.com@interloper"}})
+	if err == nil {
+		t.Error("ledger accepted claim of BID reserved for someone else")
+	}
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bidString, PIDs: []string{"Twitter.com@Reserver"}})
+	if err != nil {
+		t.Error("ledger rejected claim by reserver: " + err.Error())
+	}
+	_, reserved = theStore.reservations[bidString]
+	if reserved {
+		t.Error("reservation not cleared by claim")
+	}
+
+	// expiry cleans up
+	bid, expires, _ = theStore.allocateBID("twitter.com@reserver", now)
+	_, _, _ = theStore.allocateBID("", expires.Add(time.Second))
+	_, reserved = theStore.reservations[FormatBID(bid)]
+	if reserved {
+		t.Error("expired reservation not cleaned up")
+	}
+}
+
+func TestAllocateBIDHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	AllocateBIDHandler(w, httptest.NewRequest("POST", "/allocate-bid", strings.NewReader(`{"Requester": "twitter.com@Alloc"}`)))
+	if w.Code != 200 {
+		t.Error("allocate failed: " + w.Body.String())
+	}
+	var resp allocateBIDResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Error("bad JSON: " + err.Error())
+	}
+	if resp.ReservedFor != "twitter.com@alloc" || resp.ReservedUntil == "" {
+		t.Error("missing reservation in response")
+	}
+	fields, err := findBlueskidAssertion(resp.Assertion, 2)
+	if err != nil {
+		t.Error("bad assertion: " + err.Error())
+	} else if fields[0] != "C" || fields[1] != resp.BID {
+		t.Error("assertion doesn't claim allocated BID")
+	}
+
+	w = httptest.NewRecorder()
+	AllocateBIDHandler(w, httptest.NewRequest("POST", "/allocate-bid", nil))
+	if w.Code != 200 {
+		t.Error("anonymous allocate failed: " + w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	AllocateBIDHandler(w, httptest.NewRequest("POST", "/allocate-bid", strings.NewReader(`{"Requester": "nobody"}`)))
+	if w.Code != 400 {
+		t.Error("accepted bad requester")
+	}
+}
@@ -0,0 +1,400 @@
+package blueskidgo
+
+// Threshold approvals. An owner of a BID can post a Policy assertion, a signed assertion, see
+//  generateSignedAssertion, with opcode M naming a threshold; once the Policy is in the ledger, Grants and
+//  Transfers of that BID, Removes and Revokes that take away an owner, and further Policies, need that many of its
+//  owners, counting the one who asked, to approve them; and nothing can leave it with fewer owners than that. A
+//  change submitted without enough approvals is parked here, and its submission stays pending, until other owners
+//  post Approval assertions, opcode OK, naming the key of the change they approve. When the threshold is met the
+//  record goes in the ledger with the approvals in it. Parked changes are kept in memory, and the approvals each
+//  has so far are journaled with its submission; after a restart the journal re-queues the submission, which parks
+//  the change again with those approvals.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Approval is an owner's approval of a change, and the post it was in
+type Approval struct {
+	PID  string
+	Post string
+}
+
+// ApprovalsNeededError is the error appending a change returns when not enough owners have approved it
+type ApprovalsNeededError struct {
+	BID  string
+	Have int
+	Need int
+}
+
+func (e *ApprovalsNeededError) Error() string {
+	return fmt.Sprintf("BID %s needs approval from %d owners, and has %d", e.BID, e.Need, e.Have)
+}
+
+// ApprovalWindow is how long a parked change waits for approvals before its submission is rejected
+var ApprovalWindow = 7 * 24 * time.Hour
+
+type pendingChange struct {
+	record     *LedgerRecord
+	submission string
+	approvals  map[string]string // PID to post
+	need       int
+	created    time.Time
+	expiry     *time.Timer
+}
+
+// pendingChanges is indexed by the key of the change
+var pendingChanges = make(map[string]*pendingChange)
+var pendingLock sync.Mutex
+
+type policyAssertionRequest struct {
+	BID       string
+	Threshold int
+}
+
+type approvalAssertionRequest struct {
+	BID string
+	Key string
+}
+
+type pendingApproval struct {
+	Key        string
+	RecType    recordType
+	PIDs       []string
+	Threshold  int `json:",omitempty"`
+	Approvals  []string
+	Need       int
+	Submission string
+	Expires    time.Time
+}
+
+type pendingApprovalsResponse struct {
+	Pending []pendingApproval
+}
+
+// haveApprovals counts the owners who've approved p, including the one who asked
+func (p *pendingChange) haveApprovals() int {
+	have := 1
+	for pid := range p.approvals {
+		if pid != p.record.PIDs[0] {
+			have++
+		}
+	}
+	return have
+}
+
+// approvalList is the approvals p has, other than from the one who asked, for the record
+func (p *pendingChange) approvalList() []Approval {
+	var approvals []Approval
+	for _, pid := range sortedStringKeys(p.approvals) {
+		if pid != p.record.PIDs[0] {
+			approvals = append(approvals, Approval{PID: pid, Post: p.approvals[pid]})
+		}
+	}
+	return approvals
+}
+
+// parkChange holds record, which needs more approvals, until they arrive or ApprovalWindow, counted from when it
+// was submitted, passes. A change that's parked again after a restart starts with the approvals in record. One
+// that's already parked under another submission is turned away, since only one submission can be settled by it.
+func parkChange(record *LedgerRecord, submission string, submitted time.Time, needed *ApprovalsNeededError) (string, error) {
+	_ = normalizeRecord(record) // it's been through begin, so this can't fail
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	p, ok := pendingChanges[record.Key]
+	if ok && p.submission != submission {
+		return "", errors.New("this change is already waiting for approvals under submission " + p.submission)
+	}
+	if ok {
+		p.record = record
+		p.need = needed.Need
+	} else {
+		p = &pendingChange{record: record, submission: submission, approvals: make(map[string]string), need: needed.Need,
+			created: submitted}
+		for _, approval := range record.Approvals {
+			p.approvals[approval.PID] = approval.Post
+		}
+		pendingChanges[record.Key] = p
+		key := record.Key
+		p.expiry = time.AfterFunc(time.Until(submitted.Add(ApprovalWindow)), func() {
+			pendingLock.Lock()
+			expired := pendingChanges[key]
+			delete(pendingChanges, key)
+			pendingLock.Unlock()
+			if expired != nil {
+				settleSubmission(expired.submission, errors.New("approvals didn't arrive in time"))
+			}
+		})
+	}
+	return fmt.Sprintf("waiting for approvals (%d of %d)", p.haveApprovals(), p.need), nil
+}
+
+// approveChange adds approval, from approvalFromPost, to the change parked under its key, and if that's enough,
+// puts the change in the ledger and settles its submission
+func approveChange(approval *LedgerRecord) (retryable bool, err error) {
+	pendingLock.Lock()
+	p, ok := pendingChanges[approval.Key]
+	if !ok {
+		pendingLock.Unlock()
+		// the change may not have been processed yet
+		return true, errors.New("no change with key " + approval.Key + " is waiting for approval")
+	}
+	if p.record.BID != approval.BID {
+		pendingLock.Unlock()
+		return false, errors.New("the change with key " + approval.Key + " isn't for BID " + approval.BID)
+	}
+	approver := approval.PIDs[0]
+	var role string
+	theStore.readMappings(func(m *bidMappings) { role = m.Roles[approval.BID][approver] })
+	if role != RoleOwner {
+		pendingLock.Unlock()
+		return false, errors.New(approver + " isn't an owner of BID " + approval.BID)
+	}
+	p.approvals[approver] = approval.PostURLs[0]
+	record := *p.record
+	record.Approvals = p.approvalList()
+	enough := p.haveApprovals() >= p.need
+	if enough {
+		// this approval is the one that finishes the change, so nothing else should try to
+		delete(pendingChanges, approval.Key)
+	}
+	pendingLock.Unlock()
+
+	if !enough {
+		journalApprovals(p.submission, record.Approvals)
+		return false, nil
+	}
+	err = appendToLedger(&record)
+	needed, tooFew := err.(*ApprovalsNeededError)
+	_, unavailable := err.(*ClusterUnavailableError)
+	if tooFew || unavailable {
+		// the policy changed while the change was waiting, or the cluster couldn't take it; it goes back to waiting
+		pendingLock.Lock()
+		if tooFew {
+			p.need = needed.Need
+		}
+		pendingChanges[approval.Key] = p
+		p.expiry.Reset(time.Until(p.created.Add(ApprovalWindow)))
+		pendingLock.Unlock()
+		journalApprovals(p.submission, record.Approvals)
+		if unavailable {
+			return true, err
+		}
+		return false, nil
+	}
+	p.expiry.Stop()
+	settleSubmission(p.submission, err)
+	if err != nil {
+		return false, errors.New("the approved change failed: " + err.Error())
+	}
+	return false, nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func generatePolicyAssertion(bid uint64, threshold int) (string, error) {
+	return generateSignedAssertion("M", bid, strconv.Itoa(threshold))
+}
+
+// checkPolicyAssertion returns the BID, the threshold, and the key the assertion was signed with
+func checkPolicyAssertion(parts []string) (uint64, int, string, error) {
+	bid, subject, key, err := checkSignedAssertion(parts, "M", "BID Policy")
+	if err != nil {
+		return 0, 0, "", err
+	}
+	threshold, err := strconv.Atoi(subject)
+	if err != nil || threshold < 1 {
+		return 0, 0, "", errors.New("bad threshold in policy assertion: " + subject)
+	}
+	return bid, threshold, key, nil
+}
+
+func generateApprovalAssertion(bid uint64, changeKey string) (string, error) {
+	return generateSignedAssertion("OK", bid, changeKey)
+}
+
+// checkApprovalAssertion returns the BID and the key of the change being approved
+func checkApprovalAssertion(parts []string) (uint64, string, error) {
+	bid, changeKey, _, err := checkSignedAssertion(parts, "OK", "change Approval")
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = StringToKey(changeKey)
+	if err != nil {
+		return 0, "", errors.New("can't parse key in approval assertion: " + err.Error())
+	}
+	return bid, changeKey, nil
+}
+
+func policyRecordFromPost(post string) (record *LedgerRecord, retryable bool, err error) {
+	fields, pid, err := fetchAssertion(post, 6)
+	if err != nil {
+		return nil, true, fmt.Errorf("Failed to find assertion: %w", err)
+	}
+	bid, threshold, key, err := checkPolicyAssertion(fields)
+	if err != nil {
+		return nil, false, errors.New("policy assertion invalid: " + err.Error())
+	}
+	record = &LedgerRecord{
+		RecType:   PolicyBID,
+		BID:       FormatBID(bid),
+		PIDs:      []string{pid},
+		PostURLs:  []string{post},
+		Key:       key,
+		Threshold: threshold,
+	}
+	return
+}
+
+// approvalFromPost returns the approval, for approveChange, as a record that never goes in the ledger, so has no
+// RecType that means anything
+func approvalFromPost(post string) (record *LedgerRecord, retryable bool, err error) {
+	fields, pid, err := fetchAssertion(post, 6)
+	if err != nil {
+		return nil, true, fmt.Errorf("Failed to find assertion: %w", err)
+	}
+	bid, changeKey, err := checkApprovalAssertion(fields)
+	if err != nil {
+		return nil, false, errors.New("approval assertion invalid: " + err.Error())
+	}
+	pid, err = NormalizePID(pid)
+	if err != nil {
+		return nil, false, err
+	}
+	record = &LedgerRecord{
+		BID:      FormatBID(bid),
+		PIDs:     []string{pid},
+		PostURLs: []string{post},
+		Key:      changeKey,
+	}
+	return
+}
+
+// PolicyAssertionHandler makes the assertion to post to set a BID's approval threshold; it takes the BID and the
+// threshold. A threshold of 1 turns approvals off.
+func PolicyAssertionHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req policyAssertionRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		http.Error(w, "Invalid BID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Threshold < 1 {
+		http.Error(w, "Threshold must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := generatePolicyAssertion(bid, req.Threshold)
+	if err != nil {
+		http.Error(w, "Assertion generation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respJSON, err := json.MarshalIndent(bidAssertionResponse{Assertion: assertion}, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// ApprovalAssertionHandler makes the assertion to post to approve a change; it takes the BID and the change's key,
+// which /pending-approvals lists
+func ApprovalAssertionHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req approvalAssertionRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		http.Error(w, "Invalid BID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = StringToKey(req.Key)
+	if err != nil {
+		http.Error(w, "Invalid Key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := generateApprovalAssertion(bid, req.Key)
+	if err != nil {
+		http.Error(w, "Assertion generation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respJSON, err := json.MarshalIndent(bidAssertionResponse{Assertion: assertion}, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// SetPolicyHandler queues a submission of a posted Policy assertion
+func SetPolicyHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, PolicyBID)
+}
+
+// ApproveHandler queues a submission of a posted Approval assertion
+func ApproveHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, ApproveChange)
+}
+
+// PendingApprovalsHandler serves /pending-approvals?bid=, the changes to a BID that are waiting for approvals
+func PendingApprovalsHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	bid := httpRequest.Form.Get("bid")
+
+	if bid == "" {
+		http.Error(w, "missing parameter 'bid'", http.StatusBadRequest)
+		return
+	}
+	bid, err := NormalizeBID(bid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'bid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := pendingApprovalsResponse{Pending: []pendingApproval{}}
+	pendingLock.Lock()
+	for key, p := range pendingChanges {
+		if p.record.BID != bid {
+			continue
+		}
+		approvals := []string{}
+		for _, pid := range sortedStringKeys(p.approvals) {
+			if pid != p.record.PIDs[0] {
+				approvals = append(approvals, pid)
+			}
+		}
+		resp.Pending = append(resp.Pending, pendingApproval{Key: key, RecType: p.record.RecType, PIDs: p.record.PIDs,
+			Threshold: p.record.Threshold, Approvals: approvals, Need: p.need, Submission: p.submission,
+			Expires: p.created.Add(ApprovalWindow)})
+	}
+	pendingLock.Unlock()
+	sort.Slice(resp.Pending, func(i, j int) bool { return resp.Pending[i].Key < resp.Pending[j].Key })
+
+	respJSON, err := json.MarshalIndent(resp, "", " ")
+	writeJson(w, respJSON, err)
+}
@@ -0,0 +1,388 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApprovals(t *testing.T) {
+	defer freshLedger()()
+	approvalScenarios(t)
+	ownerChangeScenarios(t)
+
+	checkReplay(t, "policies")
+}
+
+func TestApprovalsSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	approvalScenarios(t)
+	ownerChangeScenarios(t)
+	reopenSQLiteLedger(t, path)
+}
+
+func approvalScenarios(t *testing.T) {
+	bid := "000000000000D001"
+	first, second, third, member := "twitter.com@ap1", "reddit.com@ap2", "tumblr.com@ap3", "twitter.com@apm"
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{first}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, second}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, third}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, member}, Key: newPubKey(), Role: RoleMember})
+	policy := func(by string, threshold int, approvers ...string) error {
+		record := &LedgerRecord{RecType: PolicyBID, BID: bid, PIDs: []string{by}, PostURLs: []string{"https://example.com/m"},
+			Key: newPubKey(), Threshold: threshold}
+		for _, pid := range approvers {
+			record.Approvals = append(record.Approvals, Approval{PID: pid, Post: "https://example.com/ok"})
+		}
+		return appendToLedger(record)
+	}
+	grant := func(to string, approvers ...string) error {
+		record := &LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, to}, Key: newPubKey(), Role: RoleReadOnly}
+		for _, pid := range approvers {
+			record.Approvals = append(record.Approvals, Approval{PID: pid, Post: "https://example.com/ok"})
+		}
+		return appendToLedger(record)
+	}
+
+	for _, reject := range []struct {
+		what string
+		err  error
+	}{
+		{"policy by member", policy(member, 2)},
+		{"threshold of 0", policy(first, 0)},
+		{"threshold above the owners", policy(first, 4)},
+		{"threshold on a grant", appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, "reddit.com@x"}, Key: newPubKey(), Threshold: 2})},
+		{"approvals on an unclaim", appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{member}, Approvals: []Approval{{PID: second}}})},
+	} {
+		if reject.err == nil {
+			t.Error(reject.what + ": accepted")
+		}
+	}
+
+	err := policy(first, 2)
+	if err != nil {
+		t.Fatal("policy: " + err.Error())
+	}
+	var threshold int
+	theStore.readMappings(func(m *bidMappings) { threshold = m.Thresholds[bid] })
+	if threshold != 2 {
+		t.Errorf("threshold is %d", threshold)
+	}
+
+	err = grant("reddit.com@new")
+	needed, ok := err.(*ApprovalsNeededError)
+	if !ok || needed.Have != 1 || needed.Need != 2 {
+		t.Errorf("grant without approval: %v", err)
+	}
+	err = grant("reddit.com@new", member)
+	if err == nil || !strings.Contains(err.Error(), "isn't an owner") {
+		t.Errorf("grant approved by a member: %v", err)
+	}
+	err = grant("reddit.com@new", first)
+	if _, ok := err.(*ApprovalsNeededError); !ok {
+		t.Errorf("granter approving their own grant: %v", err)
+	}
+	err = grant("reddit.com@new", second)
+	if err != nil {
+		t.Fatal("approved grant: " + err.Error())
+	}
+	records := theStore.recordsSoFar()
+	if len(records[len(records)-1].Approvals) != 1 || !theStore.isMapped(bid, "reddit.com@new") {
+		t.Error("approved grant not in the ledger")
+	}
+
+	// changing the policy needs approval too
+	if _, ok := policy(first, 1).(*ApprovalsNeededError); !ok {
+		t.Error("policy changed without approval")
+	}
+	err = policy(first, 1, third)
+	if err != nil {
+		t.Fatal("approved policy: " + err.Error())
+	}
+	if grant("tumblr.com@later") != nil {
+		t.Error("grant still needs approval after threshold of 1")
+	}
+}
+
+// ownerChangeScenarios checks that changes to who owns a BID need approvals, and can't leave it with too few
+// owners to meet its threshold
+func ownerChangeScenarios(t *testing.T) {
+	bid := "000000000000D005"
+	first, second, member, outsider := "twitter.com@oc1", "reddit.com@oc2", "tumblr.com@ocm", "reddit.com@ocx"
+	secondKey := newPubKey()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{first}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, second}, Key: secondKey})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, member}, Key: newPubKey(), Role: RoleMember})
+	approved := func(recType recordType, pids []string, key string, approvers ...string) error {
+		record := &LedgerRecord{RecType: recType, BID: bid, PIDs: pids, Key: key}
+		if key == "" {
+			record.Key = newPubKey()
+		}
+		for _, pid := range approvers {
+			record.Approvals = append(record.Approvals, Approval{PID: pid, Post: "https://example.com/ok"})
+		}
+		return appendToLedger(record)
+	}
+	err := appendToLedger(&LedgerRecord{RecType: PolicyBID, BID: bid, PIDs: []string{first}, Key: newPubKey(), Threshold: 2,
+		Approvals: []Approval{{second, "https://example.com/ok"}}})
+	if err != nil {
+		t.Fatal("policy: " + err.Error())
+	}
+
+	// a Transfer needs approvals, even to an outsider, which leaves the number of owners as it was
+	if _, ok := approved(TransferBID, []string{first, outsider}, "").(*ApprovalsNeededError); !ok {
+		t.Error("transfer without approval")
+	}
+	err = approved(TransferBID, []string{first, outsider}, "", second)
+	if err != nil {
+		t.Fatal("approved transfer: " + err.Error())
+	}
+
+	// removing a member doesn't need approvals; removing an owner does, and can't go below the threshold
+	if _, ok := approved(RemovePID, []string{outsider, second}, "").(*ApprovalsNeededError); ok {
+		t.Error("removal below the threshold parked, as if approvals could fix it")
+	}
+	err = approved(RemovePID, []string{outsider, second}, "", second)
+	if err == nil || !strings.Contains(err.Error(), "too few to meet its threshold") {
+		t.Errorf("removal below the threshold: %v", err)
+	}
+	err = approved(RemovePID, []string{outsider, member}, "")
+	if err != nil {
+		t.Error("removing a member: " + err.Error())
+	}
+
+	// nor can leaving, transferring to another owner, or revoking an owner's key
+	for _, reject := range []struct {
+		what string
+		err  error
+	}{
+		{"owner unclaiming", appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{second}})},
+		{"transfer to an owner", approved(TransferBID, []string{second, outsider}, "", outsider)},
+		{"revoking an owner's key", approved(RevokeKey, []string{outsider}, secondKey, second)},
+	} {
+		if reject.err == nil || !strings.Contains(reject.err.Error(), "too few to meet its threshold") {
+			t.Errorf("%s: %v", reject.what, reject.err)
+		}
+	}
+	if owners := len(theStore.pidsForBID(bid)); owners != 3 {
+		t.Errorf("BID has %d PIDs", owners)
+	}
+}
+
+func TestPolicyAssertions(t *testing.T) {
+	assertion, _ := generatePolicyAssertion(0xd002, 3)
+	fields, _ := findBlueskidAssertion(assertion, 6)
+	bid, threshold, key, err := checkPolicyAssertion(fields)
+	if err != nil || bid != 0xd002 || threshold != 3 || key != fields[ClaimKey] {
+		t.Errorf("policy round trip failed: %v", err)
+	}
+	fields[ClaimCounterparty] = "1"
+	_, _, _, err = checkPolicyAssertion(fields)
+	if err == nil {
+		t.Error("accepted a policy assertion with the threshold changed")
+	}
+
+	changeKey := newPubKey()
+	assertion, _ = generateApprovalAssertion(0xd002, changeKey)
+	fields, _ = findBlueskidAssertion(assertion, 6)
+	bid, approved, err := checkApprovalAssertion(fields)
+	if err != nil || bid != 0xd002 || approved != changeKey {
+		t.Errorf("approval round trip failed: %v", err)
+	}
+	_, _, _, err = checkPolicyAssertion(fields)
+	if err == nil {
+		t.Error("accepted an approval assertion as a policy assertion")
+	}
+
+	w := httptest.NewRecorder()
+	PolicyAssertionHandler(w, httptest.NewRequest("POST", "/policy-assertion", strings.NewReader(`{"BID":"d002","Threshold":0}`)))
+	if w.Code != 400 {
+		t.Error("policy-assertion took a threshold of 0")
+	}
+	w = httptest.NewRecorder()
+	ApprovalAssertionHandler(w, httptest.NewRequest("POST", "/approval-assertion", strings.NewReader(`{"BID":"d002","Key":"`+changeKey+`"}`)))
+	var resp bidAssertionResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	fields, err = findBlueskidAssertion(resp.Assertion, 6)
+	if w.Code != 200 || err != nil || fields[ClaimCounterparty] != changeKey {
+		t.Error("approval-assertion: " + w.Body.String())
+	}
+}
+
+func TestApprovalSubmissions(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	bid := uint64(0xd003)
+	owner, coOwner, member, newcomer := "twitter.com@as1", "reddit.com@as2", "tumblr.com@as3", "reddit.com@as4"
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: FormatBID(bid), PIDs: []string{owner}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: FormatBID(bid), PIDs: []string{owner, coOwner}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: FormatBID(bid), PIDs: []string{owner, member}, Key: newPubKey(), Role: RoleMember})
+	assertion, _ := generatePolicyAssertion(bid, 2)
+	fakePosts["https://example.com/policy"] = fakePost{owner, assertion}
+	g, a, _ := generateGrantAssertions(bid, owner, newcomer)
+	fakePosts["https://example.com/ap-grant"] = fakePost{owner, g}
+	fakePosts["https://example.com/ap-accept"] = fakePost{newcomer, a}
+	gFields, _ := findBlueskidAssertion(g, 6)
+	changeKey := gFields[ClaimKey]
+	assertion, _ = generateApprovalAssertion(bid, changeKey)
+	fakePosts["https://example.com/ok-member"] = fakePost{member, assertion}
+	assertion, _ = generateApprovalAssertion(bid, changeKey)
+	fakePosts["https://example.com/ok-owner"] = fakePost{coOwner, assertion}
+
+	process := func(recType submissionType, posts ...string) Submission {
+		s, _ := submit(recType, posts)
+		processSubmission(nextSubmission(t))
+		s2, _ := getSubmission(s.ID)
+		return s2
+	}
+	if s := process(PolicyBID, "https://example.com/policy"); s.State != SubmissionAccepted {
+		t.Fatal("policy: " + s.Reason)
+	}
+
+	grant := process(GrantBID, "https://example.com/ap-grant", "https://example.com/ap-accept")
+	if grant.State != SubmissionPending || grant.Reason != "waiting for approvals (1 of 2)" {
+		t.Fatalf("grant not waiting: %s %s", grant.State, grant.Reason)
+	}
+	again := process(GrantBID, "https://example.com/ap-grant", "https://example.com/ap-accept")
+	if again.State != SubmissionRejected || !strings.Contains(again.Reason, "already waiting for approvals under submission "+grant.ID) {
+		t.Errorf("same change submitted again: %s %s", again.State, again.Reason)
+	}
+	w := httptest.NewRecorder()
+	PendingApprovalsHandler(w, httptest.NewRequest("GET", "/pending-approvals?bid=d003", nil))
+	var pending pendingApprovalsResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &pending)
+	if len(pending.Pending) != 1 || pending.Pending[0].Key != changeKey || pending.Pending[0].Submission != grant.ID {
+		t.Error("pending-approvals: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	PendingApprovalsHandler(w, httptest.NewRequest("GET", "/pending-approvals", nil))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "missing parameter 'bid'") {
+		t.Error("pending-approvals without a BID: " + w.Body.String())
+	}
+
+	if s := process(ApproveChange, "https://example.com/ok-member"); s.State != SubmissionRejected {
+		t.Error("member's approval accepted")
+	}
+	if s := process(ApproveChange, "https://example.com/ok-owner"); s.State != SubmissionAccepted {
+		t.Fatal("owner's approval: " + s.Reason)
+	}
+	grant, _ = getSubmission(grant.ID)
+	if grant.State != SubmissionAccepted {
+		t.Error("approved grant not accepted: " + grant.Reason)
+	}
+	records := theStore.recordsSoFar()
+	last := records[len(records)-1]
+	if !theStore.isMapped(FormatBID(bid), newcomer) || !reflect.DeepEqual(last.Approvals, []Approval{{coOwner, "https://example.com/ok-owner"}}) {
+		t.Errorf("approved grant: %+v", last)
+	}
+	if len(pendingChanges) != 0 {
+		t.Error("approved change still pending")
+	}
+}
+
+// TestApprovalsAfterRestart checks that a waiting change keeps its approvals across a restart
+func TestApprovalsAfterRestart(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+	dir, err := ioutil.TempDir("", "blueskid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := dir + "/journal.jsonl"
+	err = OpenSubmissionJournal(path)
+	if err != nil {
+		t.Fatal("open: " + err.Error())
+	}
+	defer func() {
+		_ = submissionJournal.Close()
+		submissionJournal = nil
+	}()
+
+	bid := uint64(0xd004)
+	owners := []string{"twitter.com@ar1", "reddit.com@ar2", "tumblr.com@ar3"}
+	newcomer := "reddit.com@ar4"
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: FormatBID(bid), PIDs: owners[:1]})
+	for _, owner := range owners[1:] {
+		_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: FormatBID(bid), PIDs: []string{owners[0], owner}, Key: newPubKey()})
+	}
+	_ = appendToLedger(&LedgerRecord{RecType: PolicyBID, BID: FormatBID(bid), PIDs: owners[:1], Key: newPubKey(), Threshold: 3,
+		Approvals: []Approval{{owners[1], "https://example.com/x"}, {owners[2], "https://example.com/y"}}})
+	g, a, _ := generateGrantAssertions(bid, owners[0], newcomer)
+	fakePosts["https://example.com/ar-grant"] = fakePost{owners[0], g}
+	fakePosts["https://example.com/ar-accept"] = fakePost{newcomer, a}
+	gFields, _ := findBlueskidAssertion(g, 6)
+	for i, owner := range owners[1:] {
+		assertion, _ := generateApprovalAssertion(bid, gFields[ClaimKey])
+		fakePosts["https://example.com/ar-ok"+string(rune('1'+i))] = fakePost{owner, assertion}
+	}
+	process := func(recType submissionType, posts ...string) Submission {
+		s, _ := submit(recType, posts)
+		processSubmission(nextSubmission(t))
+		s2, _ := getSubmission(s.ID)
+		return s2
+	}
+
+	grant := process(GrantBID, "https://example.com/ar-grant", "https://example.com/ar-accept")
+	if s := process(ApproveChange, "https://example.com/ar-ok1"); s.State != SubmissionAccepted {
+		t.Fatal("first approval: " + s.Reason)
+	}
+
+	// simulate restart
+	_ = submissionJournal.Close()
+	submissionJournal = nil
+	submissions = make(map[string]*Submission)
+	pendingLock.Lock()
+	for _, p := range pendingChanges {
+		p.expiry.Stop()
+	}
+	pendingChanges = make(map[string]*pendingChange)
+	pendingLock.Unlock()
+	err = OpenSubmissionJournal(path)
+	if err != nil {
+		t.Fatal("reopen: " + err.Error())
+	}
+	processSubmission(nextSubmission(t))
+	grant, _ = getSubmission(grant.ID)
+	if grant.State != SubmissionPending || grant.Reason != "waiting for approvals (2 of 3)" {
+		t.Fatalf("grant after restart: %s %s", grant.State, grant.Reason)
+	}
+
+	if s := process(ApproveChange, "https://example.com/ar-ok2"); s.State != SubmissionAccepted {
+		t.Fatal("second approval: " + s.Reason)
+	}
+	grant, _ = getSubmission(grant.ID)
+	records := theStore.recordsSoFar()
+	if grant.State != SubmissionAccepted || len(records[len(records)-1].Approvals) != 2 {
+		t.Errorf("approved grant: %s %+v", grant.Reason, records[len(records)-1])
+	}
+}
+
+// TestApprovalType checks that approvals are a kind of submission, and not a kind of ledger record
+func TestApprovalType(t *testing.T) {
+	for _, recType := range []submissionType{ApproveChange, GrantBID} {
+		b, err := json.Marshal(recType)
+		var decoded submissionType
+		if err == nil {
+			err = json.Unmarshal(b, &decoded)
+		}
+		if err != nil || decoded != recType {
+			t.Errorf("%d round-trips to %d: %v", int(recType), int(decoded), err)
+		}
+	}
+	var decoded recordType
+	if json.Unmarshal([]byte(`"Approval"`), &decoded) == nil {
+		t.Error("Approval decoded as a ledger record type")
+	}
+	if _, ok := recTypeFromName("Approval"); ok {
+		t.Error("Approval is a ledger record type")
+	}
+}
@@ -0,0 +1,113 @@
+package blueskidgo
+
+// answers questions like "which PIDs were mapped to this BID last Tuesday?" by replaying the ledger. To keep that
+//  from getting slower as the ledger grows, a copy of the mappings is kept every so many records, and replay starts
+//  from the latest one that isn't too late. There are never more than MaxSnapshots copies: when there would be,
+//  every other one is dropped, and from then on they're made half as often.
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// SnapshotInterval is how many records apart the snapshots start out
+var SnapshotInterval = 1000
+
+// MaxSnapshots is how many snapshots are kept
+var MaxSnapshots = 32
+
+// withMappingsAsOf calls fn with the mappings as they were at asOf, which is either a ledger sequence number,
+// meaning "right after that record was appended", or an RFC3339 timestamp. An empty asOf means now. fn must not
+// modify the mappings or hang on to them.
+func (s *ledgerStore) withMappingsAsOf(asOf string, fn func(m *bidMappings)) error {
+	if asOf == "" {
+		s.readMappings(fn)
+		return nil
+	}
+
+	records := s.recordsSoFar()
+	var count int
+	sequence, err := strconv.Atoi(asOf)
+	if err == nil {
+		if sequence < 0 {
+			return errors.New("sequence number can't be negative")
+		}
+		count = sequence + 1
+		if count > len(records) {
+			count = len(records)
+		}
+	} else {
+		when, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			return errors.New("must be a ledger sequence number or an RFC3339 timestamp")
+		}
+		// When doesn't always go up: after a cluster's leader changes, the new one's clock may be behind the old
+		// one's. So this is the records up to the first one from after when, found the slow way.
+		for count < len(records) && !records[count].When.After(when) {
+			count++
+		}
+	}
+	fn(s.mappingsAfter(records, count))
+	return nil
+}
+
+// mappingsAfter returns the mappings as they were after the first count records had been appended. Snapshots are
+// made lazily, when a replay passes a snapshot point.
+func (s *ledgerStore) mappingsAfter(records []*LedgerRecord, count int) *bidMappings {
+	s.snapshotsLock.Lock()
+	if s.snapshotEvery == 0 {
+		s.snapshotEvery = SnapshotInterval
+	}
+	every := s.snapshotEvery
+	replayed := count / every * every
+	for replayed > 0 && s.snapshots[replayed] == nil {
+		replayed -= every
+	}
+	base := s.snapshots[replayed]
+	s.snapshotsLock.Unlock()
+
+	// snapshots are never changed once they're made, so this copy can be taken, and replayed onto, without the lock
+	m := newBIDMappings()
+	if base != nil {
+		m = base.clone()
+	}
+	for replayed < count {
+		m.apply(records[replayed])
+		replayed++
+		if replayed%every == 0 {
+			s.keepSnapshot(replayed, every, m)
+		}
+	}
+	return m
+}
+
+// keepSnapshot keeps a copy of m, the mappings after the first count records, unless there is one already, or
+// snapshots have been thinned out since every was current
+func (s *ledgerStore) keepSnapshot(count int, every int, m *bidMappings) {
+	s.snapshotsLock.Lock()
+	needed := s.snapshotEvery == every && s.snapshots[count] == nil
+	s.snapshotsLock.Unlock()
+	if !needed {
+		return
+	}
+	snapshot := m.clone()
+
+	s.snapshotsLock.Lock()
+	defer s.snapshotsLock.Unlock()
+	if s.snapshotEvery != every {
+		return
+	}
+	if s.snapshots == nil {
+		s.snapshots = make(map[int]*bidMappings)
+	}
+	s.snapshots[count] = snapshot
+	for len(s.snapshots) > MaxSnapshots && len(s.snapshots) > 1 {
+		s.snapshotEvery *= 2
+		for n := range s.snapshots {
+			if n%s.snapshotEvery != 0 {
+				delete(s.snapshots, n)
+			}
+		}
+	}
+}
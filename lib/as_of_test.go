@@ -0,0 +1,146 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func mappingsAsOf(t *testing.T, asOf string) *bidMappings {
+	var mappings *bidMappings
+	err := theStore.withMappingsAsOf(asOf, func(m *bidMappings) { mappings = m })
+	if err != nil {
+		t.Fatal("asOf " + asOf + ": " + err.Error())
+	}
+	return mappings
+}
+
+func TestMappingsAsOf(t *testing.T) {
+	defer freshLedger()()
+	rememberInterval := SnapshotInterval
+	SnapshotInterval = 3
+	defer func() { SnapshotInterval = rememberInterval }()
+
+	// 0: p1 claims b1, 1: p1 grants b1 to p2, 2: p2 claims b2, 3: p1 unclaims b1, 4: p2 grants b2 to p3,
+	// 5: p3 unclaims b2, 6: p4 claims b3
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "a5b1", PIDs: []string{"twitter.com@p1"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "a5b1", PIDs: []string{"twitter.com@p1", "twitter.com@p2"}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "a5b2", PIDs: []string{"twitter.com@p2"}})
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "a5b1", PIDs: []string{"twitter.com@p1"}})
+	midpoint := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "a5b2", PIDs: []string{"twitter.com@p2", "twitter.com@p3"}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "a5b2", PIDs: []string{"twitter.com@p3"}})
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "a5b3", PIDs: []string{"twitter.com@p4"}})
+	if len(theStore.recordsSoFar()) != 7 {
+		t.Fatal("setup failed")
+	}
+
+	b1, b2 := FormatBID(0xa5b1), FormatBID(0xa5b2)
+	wanted := []map[string]int{
+		{b1: 1},
+		{b1: 2},
+		{b1: 2, b2: 1},
+		{b1: 1, b2: 1},
+		{b1: 1, b2: 2},
+		{b1: 1, b2: 1},
+		{b1: 1, b2: 1},
+	}
+
+	// ask in a scrambled order, so that some answers come from snapshots and some from scratch
+	for _, sequence := range []int{4, 0, 6, 2, 1, 5, 3} {
+		m := mappingsAsOf(t, strconv.Itoa(sequence))
+		for bid, count := range wanted[sequence] {
+			if len(m.PIDsForBID[bid]) != count {
+				t.Errorf("as of %d, BID %s has %d PIDs, wanted %d", sequence, bid, len(m.PIDsForBID[bid]), count)
+			}
+		}
+	}
+	if len(theStore.snapshots) != 2 || theStore.snapshots[3] == nil || theStore.snapshots[6] == nil {
+		t.Errorf("%d snapshots, wanted 2", len(theStore.snapshots))
+	}
+
+	// the snapshots mustn't be changed by replaying on top of them
+	m := mappingsAsOf(t, "4")
+	if len(m.PIDsForBID[b2]) != 2 || len(theStore.snapshots[3].PIDsForBID[b2]) != 1 {
+		t.Error("snapshot got modified")
+	}
+
+	// by time
+	m = mappingsAsOf(t, midpoint.Format(time.RFC3339Nano))
+	if !m.PIDsForBID[b1]["twitter.com@p2"] || m.PIDsForBID[b1]["twitter.com@p1"] || len(m.PIDsForBID[b2]) != 1 {
+		t.Error("wrong mappings by time")
+	}
+	m = mappingsAsOf(t, "2001-01-01T00:00:00Z")
+	if len(m.PIDsForBID) != 0 {
+		t.Error("mappings before the ledger started")
+	}
+
+	// a record whose time is out of order, as after a cluster leader with a fast clock gives way to one with a slow
+	// one, holds back everything after it
+	records := theStore.recordsSoFar()
+	rememberWhen := records[1].When
+	records[1].When = midpoint.Add(time.Hour)
+	m = mappingsAsOf(t, midpoint.Format(time.RFC3339Nano))
+	records[1].When = rememberWhen
+	if len(m.PIDsForBID[b1]) != 1 || len(m.PIDsForBID[b2]) != 0 {
+		t.Error("wrong mappings with times out of order")
+	}
+
+	// via the handlers
+	w := httptest.NewRecorder()
+	GetPIDsForBIDHandler(w, httptest.NewRequest("GET", "/pids-for-bid?bid=a5b1&asOf=1", nil))
+	var pids getPIDsForBIDResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &pids)
+	if len(pids.PIDs) != 2 {
+		t.Error("pids-for-bid asOf: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetBIDsforPIDHandler(w, httptest.NewRequest("GET", "/bids-for-pid?pid=twitter.com@p1&asOf=3", nil))
+	var bids getBIDsforPIDResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &bids)
+	if len(bids.BIDs) != 0 {
+		t.Error("bids-for-pid asOf: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetPIDGroupHandler(w, httptest.NewRequest("GET", "/pid-group?pid=twitter.com@p2&asOf=4", nil))
+	var group getPIDGroupHandlerResult
+	_ = json.Unmarshal(w.Body.Bytes(), &group)
+	if len(group.PIDGroup) != 2 {
+		t.Error("pid-group asOf: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GetPIDGroupHandler(w, httptest.NewRequest("GET", "/pid-group?pid=twitter.com@p2&asOf=last-tuesday", nil))
+	if w.Code != 400 {
+		t.Error("accepted bogus asOf")
+	}
+}
+
+func TestSnapshotThinning(t *testing.T) {
+	defer freshLedger()()
+	defer func(interval int, max int) { SnapshotInterval, MaxSnapshots = interval, max }(SnapshotInterval, MaxSnapshots)
+	SnapshotInterval, MaxSnapshots = 1, 3
+
+	for i := 0; i < 10; i++ {
+		_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: FormatBID(uint64(0xa600 + i)), PIDs: []string{"twitter.com@thin"}})
+	}
+	for _, sequence := range []int{9, 9, 2, 7, 9} {
+		m := mappingsAsOf(t, strconv.Itoa(sequence))
+		if len(m.PIDsForBID) != sequence+1 {
+			t.Errorf("as of %d, %d BIDs", sequence, len(m.PIDsForBID))
+		}
+		if len(theStore.snapshots) > MaxSnapshots {
+			t.Errorf("%d snapshots kept", len(theStore.snapshots))
+		}
+		for n := range theStore.snapshots {
+			if n%theStore.snapshotEvery != 0 {
+				t.Errorf("snapshot at %d, when they're %d apart", n, theStore.snapshotEvery)
+			}
+		}
+	}
+	if theStore.snapshotEvery == SnapshotInterval {
+		t.Error("snapshots weren't thinned")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	goURL "net/url"
-	"strconv"
 	"strings"
 )
 
@@ -30,21 +29,31 @@ const (
 // TODO: Change to have different begin/end delimiters, the end delimiter being KEYBOARD emoji.
 func findBlueskidAssertion(text string, fieldCount int) ([]string, error) {
 	if strings.Count(text, Drum) != 2 {
-		return nil, errors.New("text does not contain a Blueskid grantAssertion")
+		return nil, &assertionTextError{"text does not contain a Blueskid grantAssertion"}
 	}
 	text = text[strings.Index(text, Drum)+len(Drum):]
 	text = text[:strings.Index(text, Drum)]
 	fields := strings.SplitN(text, Guitar, fieldCount)
 	if len(fields) != fieldCount {
-		return nil, errors.New(fmt.Sprintf("wrong number of fields (%d requested, %d found)", fieldCount, len(fields)))
+		return nil, &assertionTextError{fmt.Sprintf("wrong number of fields (%d requested, %d found)", fieldCount, len(fields))}
 	}
 	return fields, nil
 }
 
+// assertionTextError is what findBlueskidAssertion returns when there's text, but no assertion in it
+type assertionTextError struct {
+	problem string
+}
+
+func (e *assertionTextError) Error() string {
+	return e.problem
+}
+
 // generateGrantAssertions Generates two strings that represent, respectively, the holder of a BID granting it to
 //  another PID, and the PID accepting the grant. Let's call the two strings grant and Accept
 //  Each post has the syntax ga/BID/nonce/key/sig/counterparty, where
-//  - ga is either G for grant or A for Accept
+//  - ga is either G for grant or A for Accept; GM/AM and GR/AR grant the member and read-only roles instead
+//    of ownership, and T/TA transfer ownership. See grantOpcodes.
 //  - BID is the Bluesky ID, base64 of an unsigned 64-bit identifier
 //  - Nonce takes the form of an RFC3339 date stamp followed by .G in a grant, .A in an accept
 //  - The key is the conventional representation of an ed25119 public key
@@ -54,8 +63,50 @@ func findBlueskidAssertion(text string, fieldCount int) ([]string, error) {
 //  TODO: Trick just doesn't work for delimiter character, probably best to base64 the counterparty
 //
 func generateGrantAssertions(bid uint64, granter string, accepter string) (grant string, accept string, err error) {
+	return generatePairedAssertions("G", "A", bid, granter, accepter)
+}
+
+// grantOpcode is what the opcode of a paired assertion says: which side of the pair it is, whether it's a Grant
+//  or a Transfer, and for a Grant, the role being granted. G and A, which predate roles, grant ownership.
+type grantOpcode struct {
+	side    string // "G" for the granter or transferor, "A" for the accepter
+	recType recordType
+	role    string
+}
+
+var grantOpcodes = map[string]grantOpcode{
+	"G":  {"G", GrantBID, RoleOwner},
+	"A":  {"A", GrantBID, RoleOwner},
+	"GM": {"G", GrantBID, RoleMember},
+	"AM": {"A", GrantBID, RoleMember},
+	"GR": {"G", GrantBID, RoleReadOnly},
+	"AR": {"A", GrantBID, RoleReadOnly},
+	"T":  {"G", TransferBID, ""},
+	"TA": {"A", TransferBID, ""},
+}
+
+// pairedOpcodes returns the granter's and accepter's opcodes for a Grant of role, or for a Transfer
+func pairedOpcodes(recType recordType, role string) (string, string, error) {
+	var g, a string
+	for opcode, meaning := range grantOpcodes {
+		if meaning.recType == recType && meaning.role == role {
+			if meaning.side == "G" {
+				g = opcode
+			} else {
+				a = opcode
+			}
+		}
+	}
+	if g == "" || a == "" {
+		return "", "", errors.New("unknown role '" + role + "'")
+	}
+	return g, a, nil
+}
 
-	bidString := fmt.Sprintf("%X", bid)
+// generatePairedAssertions makes Grant or Transfer assertions, depending on the opcodes
+func generatePairedAssertions(gOpcode string, aOpcode string, bid uint64, granter string, accepter string) (grant string, accept string, err error) {
+
+	bidString := FormatBID(bid)
 
 	// a keypair
 	public, private, err := ed25519.GenerateKey(rand.Reader)
@@ -69,11 +120,11 @@ func generateGrantAssertions(bid uint64, granter string, accepter string) (grant
 
 	nBytes, nString := makeNonce()
 	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(private, nBytes))
-	grant = assertionFromFields("G", bidString, nString, pubString, sig, accepter)
+	grant = assertionFromFields(gOpcode, bidString, nString, pubString, sig, accepter)
 
 	nBytes, nString = makeNonce()
 	sig = base64.StdEncoding.EncodeToString(ed25519.Sign(private, nBytes))
-	accept = assertionFromFields("A", bidString, nString, pubString, sig, granter)
+	accept = assertionFromFields(aOpcode, bidString, nString, pubString, sig, granter)
 
 	// TODO: Figure out a principled way to overwrite this so it doesn't linger in memory
 	privKeyBytes := []byte(private)
@@ -82,6 +133,52 @@ func generateGrantAssertions(bid uint64, granter string, accepter string) (grant
 	return
 }
 
+// generateSignedAssertion makes a single assertion with the syntax op/BID/nonce/key/sig/subject. It's like one
+//  half of a Grant, except that the signature covers the nonce followed by the subject, so the subject can't be
+//  swapped for another.
+func generateSignedAssertion(opcode string, bid uint64, subject string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	pubString, err := KeyToString(public)
+	if err != nil {
+		return "", err
+	}
+	nBytes, nString := makeNonce()
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(private, append(nBytes, subject...)))
+	return assertionFromFields(opcode, FormatBID(bid), nString, pubString, sig, subject), nil
+}
+
+// checkSignedAssertion checks an assertion made by generateSignedAssertion, and returns the BID, the subject, and
+//  the key it was signed with. what is what to call the assertion in errors.
+func checkSignedAssertion(parts []string, opcode string, what string) (bid uint64, subject string, key string, err error) {
+	if parts[Opcode] != opcode {
+		return 0, "", "", errors.New("not a " + what + " assertion")
+	}
+	bid, err = ParseBID(parts[BID])
+	if err != nil {
+		return 0, "", "", err
+	}
+	pubKey, err := StringToKey(parts[ClaimKey])
+	if err != nil {
+		return 0, "", "", errors.New("can't parse public key in " + what + " assertion: " + err.Error())
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[ClaimSig])
+	if err != nil {
+		return 0, "", "", errors.New("malformed signature in " + what + " assertion: " + err.Error())
+	}
+	nBytes, err := base64.StdEncoding.DecodeString(parts[ClaimNonce])
+	if err != nil {
+		return 0, "", "", errors.New("malformed base64 in nonce")
+	}
+	subject = parts[ClaimCounterparty]
+	if !ed25519.Verify(pubKey, append(nBytes, subject...), sig) {
+		return 0, "", "", errors.New(what + " assertion signature validation failed")
+	}
+	return bid, subject, parts[ClaimKey], nil
+}
+
 func makeNonce() ([]byte, string) {
 	nb := make([]byte, 8)
 	_, _ = rand.Read(nb)
@@ -98,39 +195,64 @@ func assertionFromFields(fields ...string) string {
 }
 
 func checkGrantAssertionPair(gFields []string, gPID string, aFields []string, aPID string) (uint64, error) {
+	granter, err := checkPairedAssertions(gFields, gPID, aFields, aPID)
+	if err != nil {
+		return 0, err
+	}
+	return granter.bid, nil
+}
+
+// checkPairedAssertions checks a Grant or Transfer pair, and returns the granter's half
+func checkPairedAssertions(gFields []string, gPID string, aFields []string, aPID string) (*grantAssertion, error) {
 
 	granter, err := checkGrantAssertion(gFields)
 	if err != nil {
-		return 0, errors.New("invalid granter assertion: " + err.Error())
+		return nil, errors.New("invalid granter assertion: " + err.Error())
 	}
 
 	accepter, err := checkGrantAssertion(aFields)
 	if err != nil {
-		return 0, errors.New("invalid accepter assertion: " + err.Error())
+		return nil, errors.New("invalid accepter assertion: " + err.Error())
 	}
 
 	if !granter.pubKey.Equal(accepter.pubKey) {
-		return 0, errors.New("granter and accepter not signed with same key")
+		return nil, errors.New("granter and accepter not signed with same key")
 	}
 	if granter.nonce == accepter.nonce {
-		return 0, errors.New("granter and accepter used same nonce")
+		return nil, errors.New("granter and accepter used same nonce")
+	}
+	if granter.opcode.side != "G" || accepter.opcode.side != "A" {
+		return nil, errors.New("granter and accepter assertions are the wrong way round")
+	}
+	if granter.opcode.recType != accepter.opcode.recType || granter.opcode.role != accepter.opcode.role {
+		return nil, errors.New("granter and accepter assertions don't agree on what's being granted")
 	}
 	if granter.bid != accepter.bid {
-		return 0, errors.New("granter and accepter BIDs differ")
+		return nil, errors.New("granter and accepter BIDs differ")
 	}
 
+	// PIDs fetched from posts may not be in canonical form, e.g. twitter.com@TimBray
+	gPID, err = NormalizePID(gPID)
+	if err != nil {
+		return nil, errors.New("invalid granter PID: " + err.Error())
+	}
+	aPID, err = NormalizePID(aPID)
+	if err != nil {
+		return nil, errors.New("invalid accepter PID: " + err.Error())
+	}
 	if accepter.counterparty != gPID {
-		return 0, errors.New("accepter assertion does not identify granter")
+		return nil, errors.New("accepter assertion does not identify granter")
 	}
 	if granter.counterparty != aPID {
-		return 0, errors.New("granter assertion does not identify accepter")
+		return nil, errors.New("granter assertion does not identify accepter")
 	}
 
-	return granter.bid, nil
+	return granter, nil
 }
 
 type grantAssertion struct {
 	ga           string
+	opcode       grantOpcode
 	bid          uint64
 	counterparty string
 	nonce        string
@@ -142,12 +264,14 @@ func checkGrantAssertion(parts []string) (*grantAssertion, error) {
 	var a grantAssertion
 
 	ga := parts[Opcode]
-	if !(ga == "G" || ga == "A") {
-		return nil, errors.New("grant/Accept must begin with either 'A' or 'G'")
+	opcode, ok := grantOpcodes[ga]
+	if !ok {
+		return nil, errors.New("grant/Accept must begin with one of 'G', 'A', 'GM', 'AM', 'GR', 'AR', 'T', or 'TA'")
 	}
 	a.ga = ga
+	a.opcode = opcode
 
-	bid, err := strconv.ParseUint(parts[BID], 16, 64)
+	bid, err := ParseBID(parts[BID])
 	if err != nil {
 		return nil, err
 	}
@@ -175,11 +299,18 @@ func checkGrantAssertion(parts []string) (*grantAssertion, error) {
 		return nil, errors.New("grantAssertion signature vaildation failed")
 	}
 
-	a.counterparty = parts[ClaimCounterparty]
+	counterparty, err := NormalizePID(parts[ClaimCounterparty])
+	if err != nil {
+		return nil, errors.New("bad counterparty in grantAssertion: " + err.Error())
+	}
+	a.counterparty = counterparty
 
 	return &a, nil
 }
 
+// fetchAssertion is what everyone should call; it's a variable so tests can avoid going out to the network
+var fetchAssertion = fetchAssertionFromPost
+
 func fetchAssertionFromPost(rawURL string, fieldCount int) (assertionFields []string, pid string, err error) {
 
 	url, err := goURL.Parse(rawURL)
@@ -2,10 +2,10 @@ package blueskidgo
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 )
 
 type bidRequest struct {
@@ -17,9 +17,23 @@ type grantRequest struct {
 	AcceptPost string
 }
 
-// no response bodies to the BID-update calls
+type transferRequest struct {
+	TransferPost string
+	AcceptPost   string
+}
+
+// The BID-update calls don't fetch anything; they queue a submission and return its ticket right away. See
+// submissions.go for what happens next.
 
 func ClaimBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, ClaimBID)
+}
+
+func UnclaimBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, UnclaimBID)
+}
+
+func bidUpdateHandler(w http.ResponseWriter, httpRequest *http.Request, recType submissionType) {
 	body := openPost(w, httpRequest)
 	if body == nil {
 		return
@@ -30,36 +44,12 @@ func ClaimBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	fields, pid, err := fetchAssertionFromPost(req.Post, 2)
-	if err != nil {
-		http.Error(w, "Failed to find assertion: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	if fields[0] != "C" {
-		http.Error(w, "not a BID Claim assertion", http.StatusBadRequest)
-		return
-	}
-
-	bid, err := strconv.ParseUint(fields[1], 16, 64)
-	if err != nil {
-		http.Error(w, "BID in Claim assertion is not a hex 64-bit quantity", http.StatusBadRequest)
+	if req.Post == "" {
+		http.Error(w, "Missing field 'Post'", http.StatusBadRequest)
 		return
 	}
-	err = appendToLedger(&LedgerRecord{
-		RecType:  ClaimBID,
-		BID:      fmt.Sprintf("%016X", bid),
-		PIDs:     []string{pid},
-		PostURLs: []string{req.Post},
-	})
 
-	if err != nil {
-		http.Error(w, "Database update rejected: "+err.Error(), http.StatusBadRequest)
-	}
-
-	w.WriteHeader(http.StatusOK)
-	return
+	submitAndRespond(w, recType, []string{req.Post})
 }
 
 func GrantBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
@@ -73,78 +63,121 @@ func GrantBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	gFields, gPID, err := fetchAssertionFromPost(req.GrantPost, 6)
-	if err != nil {
-		http.Error(w, "Failed to fetch assertion: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-	aFields, aPID, err := fetchAssertionFromPost(req.AcceptPost, 6)
-	if err != nil {
-		http.Error(w, "Failed to fetch assertion: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	bid, err := checkGrantAssertionPair(gFields, gPID, aFields, aPID)
-	if err != nil {
-		http.Error(w, "grant and accept assertions invalid: "+err.Error(), http.StatusBadRequest)
+	if req.GrantPost == "" || req.AcceptPost == "" {
+		http.Error(w, "Missing fields in JSON request", http.StatusBadRequest)
 		return
 	}
 
-	err = appendToLedger(&LedgerRecord{
-		RecType:  GrantBID,
-		BID:      fmt.Sprintf("%016X", bid),
-		PIDs:     []string{gPID, aPID},
-		PostURLs: []string{req.GrantPost, req.AcceptPost},
-		Key:      gFields[ClaimKey],
-	})
-	if err != nil {
-		http.Error(w, "Database update rejected: "+err.Error(), http.StatusBadRequest)
-	}
-
-	w.WriteHeader(http.StatusOK)
-	return
+	submitAndRespond(w, GrantBID, []string{req.GrantPost, req.AcceptPost})
 }
 
-func UnclaimBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
+func TransferBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 	body := openPost(w, httpRequest)
 	if body == nil {
 		return
 	}
-	var req bidRequest
+	var req transferRequest
 	err := json.Unmarshal(body, &req)
 	if err != nil {
 		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if req.TransferPost == "" || req.AcceptPost == "" {
+		http.Error(w, "Missing fields in JSON request", http.StatusBadRequest)
+		return
+	}
+
+	submitAndRespond(w, TransferBID, []string{req.TransferPost, req.AcceptPost})
+}
 
-	fields, pid, err := fetchAssertionFromPost(req.Post, 2)
+// recordFromPosts fetches the posts and checks the assertions in them, producing a record ready to be appended
+// to the ledger. If the problem was in fetching, as opposed to what was fetched, retryable is true.
+func recordFromPosts(recType submissionType, posts []string) (record *LedgerRecord, retryable bool, err error) {
+	wantedPosts := 1
+	if recType == GrantBID || recType == TransferBID {
+		wantedPosts = 2
+	}
+	if len(posts) != wantedPosts {
+		return nil, false, errors.New("wrong number of posts")
+	}
+	switch recType {
+	case ClaimBID:
+		return bidRecordFromPost(ClaimBID, "C", posts[0])
+	case UnclaimBID:
+		return bidRecordFromPost(UnclaimBID, "U", posts[0])
+	case GrantBID, TransferBID:
+		return grantRecordFromPosts(recordType(recType), posts[0], posts[1])
+	case RevokeKey:
+		return revokeRecordFromPost(posts[0])
+	case RemovePID:
+		return removeRecordFromPost(posts[0])
+	case PolicyBID:
+		return policyRecordFromPost(posts[0])
+	case ApproveChange:
+		return approvalFromPost(posts[0])
+	}
+	return nil, false, errors.New("unknown record type")
+}
+
+func bidRecordFromPost(recType recordType, opcode string, post string) (record *LedgerRecord, retryable bool, err error) {
+	fields, pid, err := fetchAssertion(post, 2)
 	if err != nil {
-		http.Error(w, "Failed to find assertion: "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, true, fmt.Errorf("Failed to find assertion: %w", err)
 	}
+	record, err = bidRecordFromAssertion(recType, opcode, post, fields, pid)
+	return record, false, err
+}
 
-	if fields[0] != "U" {
-		http.Error(w, "not a BID Unclaim assertion", http.StatusBadRequest)
-		return
+// bidRecordFromAssertion checks the assertion fetched from post, which pid posted
+func bidRecordFromAssertion(recType recordType, opcode string, post string, fields []string, pid string) (*LedgerRecord, error) {
+	if fields[Opcode] != opcode {
+		return nil, errors.New("not a BID " + recTypeNames[recType] + " assertion")
 	}
 
-	bid, err := strconv.ParseUint(fields[1], 16, 64)
+	bid, err := ParseBID(fields[BID])
 	if err != nil {
-		http.Error(w, "BID in Unclaim assertion is not a hex 64-bit quantity", http.StatusBadRequest)
-		return
+		return nil, errors.New("BID in " + recTypeNames[recType] + " assertion is invalid: " + err.Error())
 	}
-	err = appendToLedger(&LedgerRecord{
-		RecType:  UnclaimBID,
-		BID:      fmt.Sprintf("%016X", bid),
+	return &LedgerRecord{
+		RecType:  recType,
+		BID:      FormatBID(bid),
 		PIDs:     []string{pid},
-		PostURLs: []string{req.Post},
-	})
+		PostURLs: []string{post},
+	}, nil
+}
+
+func grantRecordFromPosts(recType recordType, grantPost string, acceptPost string) (record *LedgerRecord, retryable bool, err error) {
+	gFields, gPID, err := fetchAssertion(grantPost, 6)
+	if err != nil {
+		return nil, true, fmt.Errorf("Failed to fetch assertion: %w", err)
+	}
+	aFields, aPID, err := fetchAssertion(acceptPost, 6)
 	if err != nil {
-		http.Error(w, "Database update rejected: "+err.Error(), http.StatusBadRequest)
+		return nil, true, fmt.Errorf("Failed to fetch assertion: %w", err)
 	}
+	record, err = grantRecordFromAssertions(recType, grantPost, gFields, gPID, acceptPost, aFields, aPID)
+	return record, false, err
+}
 
-	w.WriteHeader(http.StatusOK)
-	return
+// grantRecordFromAssertions checks the pair of assertions fetched from grantPost and acceptPost
+func grantRecordFromAssertions(recType recordType, grantPost string, gFields []string, gPID string,
+	acceptPost string, aFields []string, aPID string) (*LedgerRecord, error) {
+	granter, err := checkPairedAssertions(gFields, gPID, aFields, aPID)
+	if err != nil {
+		return nil, errors.New("grant and accept assertions invalid: " + err.Error())
+	}
+	if granter.opcode.recType != recType {
+		return nil, errors.New("not BID " + recTypeNames[recType] + " assertions")
+	}
+
+	return &LedgerRecord{
+		RecType:  recType,
+		BID:      FormatBID(granter.bid),
+		PIDs:     []string{gPID, aPID},
+		PostURLs: []string{grantPost, acceptPost},
+		Key:      gFields[ClaimKey],
+		Role:     granter.opcode.role,
+	}, nil
 }
 
 func openPost(w http.ResponseWriter, req *http.Request) []byte {
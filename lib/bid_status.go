@@ -0,0 +1,114 @@
+package blueskidgo
+
+// A BID that's never been claimed is unclaimed; while it has PIDs it's active; once the last of them has left,
+//  it's tombstoned. Whether a tombstoned BID can be claimed again, by anyone, is a matter of policy: by default it
+//  can't, since whoever finds the BID somewhere will take it to mean whoever held it before.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	BIDUnclaimed  = "unclaimed"
+	BIDActive     = "active"
+	BIDTombstoned = "tombstoned"
+)
+
+// BIDReusePolicy says whether a tombstoned BID can be claimed again, and if so, how long after it was tombstoned
+type BIDReusePolicy struct {
+	Allowed bool
+	After   time.Duration
+}
+
+// BIDReuse is the policy the server applies to Claims of tombstoned BIDs
+var BIDReuse BIDReusePolicy
+
+// ParseBIDReusePolicy takes "never", "always", or a duration, such as "720h", after which a tombstoned BID can be
+// claimed again
+func ParseBIDReusePolicy(s string) (BIDReusePolicy, error) {
+	switch s {
+	case "never":
+		return BIDReusePolicy{}, nil
+	case "always":
+		return BIDReusePolicy{Allowed: true}, nil
+	}
+	after, err := time.ParseDuration(s)
+	if err != nil || after < 0 {
+		return BIDReusePolicy{}, errors.New("BID reuse policy must be 'never', 'always', or a duration")
+	}
+	return BIDReusePolicy{Allowed: true, After: after}, nil
+}
+
+// reclaimable is true if a BID tombstoned at since can be claimed again at now
+func (p BIDReusePolicy) reclaimable(since time.Time, now time.Time) bool {
+	return p.Allowed && !now.Before(since.Add(p.After))
+}
+
+// checkReuse refuses a Claim of bid, at now, if it's been tombstoned and BIDReuse doesn't let it be claimed again
+func checkReuse(indexes ledgerIndexes, bid string, now time.Time) error {
+	since, tombstoned, err := indexes.tombstoned(bid)
+	if err != nil {
+		return err
+	}
+	if tombstoned && !BIDReuse.reclaimable(since, now) {
+		return errors.New("BID '" + bid + "' has been retired and can't be claimed again")
+	}
+	return nil
+}
+
+type bidStatusResponse struct {
+	BID         string
+	Status      string
+	Tombstoned  *time.Time `json:",omitempty"` // when the last PID left
+	Reclaimable bool       `json:",omitempty"` // whether it can be claimed again now
+}
+
+// bidStatus says whether bid is unclaimed, active, or tombstoned
+func (m *bidMappings) bidStatus(bid string, now time.Time) bidStatusResponse {
+	resp := bidStatusResponse{BID: bid, Status: BIDUnclaimed}
+	if since, ok := m.Tombstones[bid]; ok {
+		resp.Status = BIDTombstoned
+		resp.Tombstoned = &since
+		resp.Reclaimable = BIDReuse.reclaimable(since, now)
+	} else if _, ok := m.PIDsForBID[bid]; ok {
+		resp.Status = BIDActive
+	}
+	return resp
+}
+
+// bidStatus says whether bid is unclaimed, active, or tombstoned, as of now
+func (s *ledgerStore) bidStatus(bid string, now time.Time) (resp bidStatusResponse) {
+	s.readMappings(func(m *bidMappings) { resp = m.bidStatus(bid, now) })
+	return
+}
+
+// BIDStatusHandler serves /bid-status?bid=
+func BIDStatusHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	bid := httpRequest.Form.Get("bid")
+
+	if bid == "" {
+		http.Error(w, "missing parameter 'bid'", http.StatusBadRequest)
+		return
+	}
+	bid, err := NormalizeBID(bid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'bid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var resp bidStatusResponse
+	err = storeFor(httpRequest).withMappingsAsOf(httpRequest.Form.Get("asOf"), func(m *bidMappings) {
+		resp = m.bidStatus(bid, time.Now())
+	})
+	if err != nil {
+		http.Error(w, "invalid parameter 'asOf': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	respJSON, err := json.MarshalIndent(resp, "", " ")
+	writeJson(w, respJSON, err)
+}
@@ -0,0 +1,148 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	defer freshLedger()()
+	tombstoneScenarios(t)
+
+	// the policy is only for the server that took the Claim; replaying its ledger elsewhere doesn't recheck it
+	BIDReuse = BIDReusePolicy{}
+	checkReplay(t, "a reclaim")
+}
+
+func TestTombstonesSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	tombstoneScenarios(t)
+	reopenSQLiteLedger(t, path)
+}
+
+func tombstoneScenarios(t *testing.T) {
+	defer func(saved BIDReusePolicy) { BIDReuse = saved }(BIDReuse)
+	bid := "000000000000E501"
+	first, second, later := "twitter.com@ts1", "reddit.com@ts2", "tumblr.com@ts3"
+	status := func() bidStatusResponse { return theStore.bidStatus(bid, time.Now()) }
+	claim := func(pid string) error {
+		return appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{pid}})
+	}
+	unclaim := func(pid string) error {
+		return appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{pid}})
+	}
+
+	if status().Status != BIDUnclaimed {
+		t.Errorf("new BID is %s", status().Status)
+	}
+	_ = claim(first)
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{first, second}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: PolicyBID, BID: bid, PIDs: []string{first}, Key: newPubKey(), Threshold: 2})
+	if unclaim(first) == nil {
+		t.Error("owners left below the threshold")
+	}
+	_ = appendToLedger(&LedgerRecord{RecType: PolicyBID, BID: bid, PIDs: []string{first}, Key: newPubKey(), Threshold: 1,
+		Approvals: []Approval{{second, "https://example.com/ok"}}})
+	_ = unclaim(first)
+	if status().Status != BIDActive || status().Tombstoned != nil {
+		t.Errorf("BID with a PID left is %+v", status())
+	}
+	_ = unclaim(second)
+	s := status()
+	if s.Status != BIDTombstoned || s.Tombstoned == nil || s.Reclaimable {
+		t.Errorf("emptied BID is %+v", s)
+	}
+
+	BIDReuse = BIDReusePolicy{}
+	err := claim(later)
+	if err == nil || !strings.Contains(err.Error(), "retired") {
+		t.Errorf("reclaimed under 'never': %v", err)
+	}
+	BIDReuse = BIDReusePolicy{Allowed: true, After: time.Hour}
+	if claim(later) == nil {
+		t.Error("reclaimed too soon")
+	}
+	BIDReuse = BIDReusePolicy{Allowed: true}
+	if !status().Reclaimable {
+		t.Error("tombstoned BID not reclaimable under 'always'")
+	}
+	err = claim(later)
+	if err != nil {
+		t.Fatal("reclaim: " + err.Error())
+	}
+	if status().Status != BIDActive || !reflect.DeepEqual(theStore.pidsForBID(bid), []string{later}) {
+		t.Errorf("reclaimed BID is %+v", status())
+	}
+	if claim(first) == nil {
+		t.Error("active BID claimed")
+	}
+
+	// it starts afresh: no threshold left over from before
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{later, first}, Key: newPubKey()})
+	if err != nil {
+		t.Error("grant after reclaim: " + err.Error())
+	}
+}
+
+func TestBIDReusePolicy(t *testing.T) {
+	for s, wanted := range map[string]BIDReusePolicy{
+		"never":  {},
+		"always": {Allowed: true},
+		"720h":   {Allowed: true, After: 720 * time.Hour},
+	} {
+		policy, err := ParseBIDReusePolicy(s)
+		if err != nil || policy != wanted {
+			t.Errorf("%s: %+v %v", s, policy, err)
+		}
+	}
+	for _, bad := range []string{"", "sometimes", "-1h"} {
+		_, err := ParseBIDReusePolicy(bad)
+		if err == nil {
+			t.Error("parsed " + bad)
+		}
+	}
+	since := time.Now()
+	policy := BIDReusePolicy{Allowed: true, After: time.Hour}
+	if policy.reclaimable(since, since.Add(time.Minute)) || !policy.reclaimable(since, since.Add(time.Hour)) {
+		t.Error("reuse delay not applied")
+	}
+}
+
+func TestBIDStatusHandler(t *testing.T) {
+	defer freshLedger()()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "e502", PIDs: []string{"twitter.com@bs1"}})
+
+	for query, wanted := range map[string]string{"e502": BIDActive, "e503": BIDUnclaimed} {
+		w := httptest.NewRecorder()
+		BIDStatusHandler(w, httptest.NewRequest("GET", "/bid-status?bid="+query, nil))
+		var resp bidStatusResponse
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		bid, _ := ParseBID(query)
+		if w.Code != 200 || resp.Status != wanted || resp.BID != FormatBID(bid) {
+			t.Errorf("%s: %s", query, w.Body.String())
+		}
+	}
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "e502", PIDs: []string{"twitter.com@bs1"}})
+	w := httptest.NewRecorder()
+	BIDStatusHandler(w, httptest.NewRequest("GET", "/bid-status?bid=e502", nil))
+	if !strings.Contains(w.Body.String(), `"Status": "tombstoned"`) || !strings.Contains(w.Body.String(), `"Tombstoned"`) {
+		t.Error("tombstoned: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	BIDStatusHandler(w, httptest.NewRequest("GET", "/bid-status?bid=e502&asOf=0", nil))
+	if !strings.Contains(w.Body.String(), `"Status": "active"`) {
+		t.Error("asOf: " + w.Body.String())
+	}
+	for _, query := range []string{"", "?bid=nope", "?bid=e502&asOf=nope"} {
+		w = httptest.NewRecorder()
+		BIDStatusHandler(w, httptest.NewRequest("GET", "/bid-status"+query, nil))
+		if w.Code != 400 {
+			t.Error("bad request accepted: " + query)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package blueskidgo
+
+// Clustered mode. Three or five servers keep the ledger together using Raft (github.com/hashicorp/raft). An append
+//  isn't applied where it's requested: the leader puts it in the Raft log, and once a quorum has the log entry,
+//  every server applies it to its own store, in log order, with the usual checks. Since the checks are
+//  deterministic and everyone sees the same records in the same order, everyone accepts and rejects the same
+//  records, and two claims of one BID can't both succeed no matter where they came in.
+// Each server's Raft ID is its public HTTP URL, so followers can send writes to the leader.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// ClusterApplyTimeout is how long an append waits for the cluster to commit it
+var ClusterApplyTimeout = 10 * time.Second
+
+type Cluster struct {
+	raft  *raft.Raft
+	store *ledgerStore
+}
+
+// ClusterUnavailableError means the cluster couldn't be asked about an append, or didn't answer in time: maybe
+// this server isn't the leader, or there's no quorum. It says nothing about whether the record is acceptable, so
+// it's worth trying again later. If it was a timeout, the record may yet be committed.
+type ClusterUnavailableError struct {
+	Reason string
+}
+
+func (e *ClusterUnavailableError) Error() string {
+	return "cluster unavailable: " + e.Reason
+}
+
+// ParseClusterPeers reads a comma-separated list of url=address pairs, each giving a server's public HTTP URL and
+// the host:port it uses for Raft traffic
+func ParseClusterPeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(s, ",") {
+		i := strings.LastIndex(peer, "=")
+		if i < 1 || i == len(peer)-1 {
+			return nil, errors.New("cluster peer '" + peer + "' should look like http://host:8123=host:9123")
+		}
+		peers[strings.TrimSuffix(peer[:i], "/")] = peer[i+1:]
+	}
+	if len(peers) != 3 && len(peers) != 5 {
+		return nil, errors.New("a cluster should have 3 or 5 servers")
+	}
+	return peers, nil
+}
+
+// StartCluster joins this server, whose URL is id, to the cluster of peers (which includes this server), keeping
+// Raft's log and snapshots in dir. From then on, theStore's appends go through the cluster.
+func StartCluster(id string, peers map[string]string, dir string) (*Cluster, error) {
+	id = strings.TrimSuffix(id, "/")
+	address, ok := peers[id]
+	if !ok {
+		return nil, errors.New("this server (" + id + ") isn't one of the cluster peers")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	tcpAddress, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(address, tcpAddress, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(id)
+	return newCluster(theStore, config, transport, boltStore, boltStore, snapshots, clusterServers(peers))
+}
+
+func clusterServers(peers map[string]string) []raft.Server {
+	var servers []raft.Server
+	for url, address := range peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(url), Address: raft.ServerAddress(address)})
+	}
+	return servers
+}
+
+// newCluster starts Raft for store. Every server is bootstrapped with the same configuration the first time it
+// starts, which Raft is fine with.
+func newCluster(store *ledgerStore, config *raft.Config, transport raft.Transport, logs raft.LogStore,
+	stable raft.StableStore, snapshots raft.SnapshotStore, servers []raft.Server) (*Cluster, error) {
+	if store.db != nil {
+		return nil, errors.New("clustered ledgers are kept by Raft, not in a database")
+	}
+	existing, err := raft.HasExistingState(logs, stable, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		err = raft.BootstrapCluster(config, logs, stable, snapshots, transport, raft.Configuration{Servers: servers})
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Cluster{store: store}
+	c.raft, err = raft.NewRaft(config, (*clusterFSM)(store), logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	store.lock.Lock()
+	store.cluster = c
+	store.lock.Unlock()
+	return c, nil
+}
+
+// Shutdown stops this server taking part in the cluster
+func (c *Cluster) Shutdown() error {
+	return c.raft.Shutdown().Error()
+}
+
+// append is appendToLedger in clustered mode; it only works on the leader
+func (c *Cluster) append(record *LedgerRecord) error {
+	if c.raft.State() != raft.Leader {
+		return &ClusterUnavailableError{"this server isn't the leader"}
+	}
+
+	// reservations are only known to the leader that made them, and BIDReuse is this server's setting, so they get
+	// checked here, not in the log
+	s := c.store
+	proposed := *record
+	proposed.PIDs = append([]string(nil), record.PIDs...)
+	err := normalizeRecord(&proposed)
+	if err != nil {
+		return err
+	}
+	proposed.When = time.Now().UTC()
+	if proposed.RecType == ClaimBID {
+		s.lock.RLock()
+		err = checkReuse(s, proposed.BID, proposed.When)
+		if err == nil {
+			err = s.checkReservation(proposed.BID, proposed.PIDs[0], proposed.When)
+		}
+		s.lock.RUnlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	command, err := json.Marshal(&proposed)
+	if err != nil {
+		return err
+	}
+	future := c.raft.Apply(command, ClusterApplyTimeout)
+	if future.Error() != nil {
+		return &ClusterUnavailableError{future.Error().Error()}
+	}
+	result := future.Response().(*clusterResult)
+	if result.err != nil {
+		return result.err
+	}
+	*record = result.record
+	record.PIDs = append([]string(nil), result.record.PIDs...)
+	record.PostURLs = append([]string(nil), result.record.PostURLs...)
+	record.Approvals = append([]Approval(nil), result.record.Approvals...)
+
+	// every server applies the record, and a restarted one applies them all over again, but this is the one that
+	// took the append, so it's the one that announces it
+	if s.announce {
+		s.lock.RLock()
+		announceAppend(&result.record)
+		s.lock.RUnlock()
+	}
+	return nil
+}
+
+// leading is true unless s is in a cluster, and this server isn't its leader
+func (s *ledgerStore) leading() bool {
+	s.lock.RLock()
+	c := s.cluster
+	s.lock.RUnlock()
+	return c == nil || c.raft.State() == raft.Leader
+}
+
+// LeaderOnly wraps a handler for requests that change the ledger, so that followers send them to the leader
+func (c *Cluster) LeaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, httpRequest *http.Request) {
+		if c.raft.State() == raft.Leader {
+			handler(w, httpRequest)
+			return
+		}
+		_, leader := c.raft.LeaderWithID()
+		if leader == "" {
+			http.Error(w, "the cluster has no leader at the moment, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Location", string(leader)+httpRequest.URL.RequestURI())
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}
+}
+
+// clusterFSM is the store, as Raft sees it
+type clusterFSM ledgerStore
+
+type clusterResult struct {
+	record LedgerRecord
+	err    error
+}
+
+// Apply is called on every server for every committed log entry, in order
+func (f *clusterFSM) Apply(entry *raft.Log) interface{} {
+	var record LedgerRecord
+	err := json.Unmarshal(entry.Data, &record)
+	if err != nil {
+		return &clusterResult{err: err}
+	}
+	s := (*ledgerStore)(f)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	txn, err := s.begin(&record, record.When)
+	if err == nil {
+		txn.replicated = true
+		err = txn.run()
+	}
+	return &clusterResult{record: record, err: err}
+}
+
+// Snapshot hangs on to the records so far; since they never change, Persist can write them out later
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return &clusterSnapshot{records: (*ledgerStore)(f).recordsSoFar()}, nil
+}
+
+// Restore replaces everything in the store with the ledger in the snapshot
+func (f *clusterFSM) Restore(snapshot io.ReadCloser) error {
+	defer func() { _ = snapshot.Close() }()
+	s := (*ledgerStore)(f)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.records = make([]*LedgerRecord, 0)
+	s.mappings = newBIDMappings()
+	s.keysUsed = make(map[string]bool)
+	s.snapshotsLock.Lock()
+	s.snapshots = nil
+	s.snapshotEvery = 0
+	s.snapshotsLock.Unlock()
+
+	lines := bufio.NewScanner(snapshot)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lines.Scan() {
+		var record LedgerRecord
+		err := json.Unmarshal(lines.Bytes(), &record)
+		if err != nil {
+			return errors.New("corrupt snapshot: " + err.Error())
+		}
+		txn, err := s.begin(&record, record.When)
+		if err == nil && txn.next.Hash != record.Hash {
+			err = errors.New("hash doesn't match")
+		}
+		if err == nil {
+			txn.replicated = true
+			err = txn.run()
+		}
+		if err != nil {
+			return errors.New("bad record in snapshot: " + err.Error())
+		}
+	}
+	return lines.Err()
+}
+
+type clusterSnapshot struct {
+	records []*LedgerRecord
+}
+
+func (snapshot *clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	for _, record := range snapshot.records {
+		line, err := json.Marshal(record)
+		if err == nil {
+			_, err = w.Write(append(line, '\n'))
+		}
+		if err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (snapshot *clusterSnapshot) Release() {}
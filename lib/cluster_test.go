@@ -0,0 +1,391 @@
+package blueskidgo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type testCluster struct {
+	nodes      []*Cluster
+	stores     []*ledgerStore
+	transports []*raft.InmemTransport
+}
+
+// newTestCluster starts size servers on one set of in-memory transports, with timeouts short enough for tests
+func newTestCluster(t *testing.T, size int) *testCluster {
+	tc := &testCluster{}
+	var servers []raft.Server
+	for i := 0; i < size; i++ {
+		address, transport := raft.NewInmemTransport("")
+		tc.transports = append(tc.transports, transport)
+		servers = append(servers, raft.Server{ID: raft.ServerID("http://node" + strconv.Itoa(i)), Address: address})
+	}
+	for _, a := range tc.transports {
+		for _, b := range tc.transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+	for i := 0; i < size; i++ {
+		config := raft.DefaultConfig()
+		config.LocalID = servers[i].ID
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = io.Discard
+		store := newLedgerStore()
+		logs := raft.NewInmemStore()
+		node, err := newCluster(store, config, tc.transports[i], logs, logs, raft.NewInmemSnapshotStore(), servers)
+		if err != nil {
+			t.Fatal("start cluster: " + err.Error())
+		}
+		tc.nodes = append(tc.nodes, node)
+		tc.stores = append(tc.stores, store)
+	}
+	return tc
+}
+
+func (tc *testCluster) shutdown() {
+	for _, node := range tc.nodes {
+		_ = node.Shutdown()
+	}
+}
+
+// isolate cuts node i off from the others, or with connected set, puts it back
+func (tc *testCluster) isolate(i int, connected bool) {
+	for j, other := range tc.transports {
+		if j == i {
+			continue
+		}
+		if connected {
+			tc.transports[i].Connect(other.LocalAddr(), other)
+			other.Connect(tc.transports[i].LocalAddr(), tc.transports[i])
+		} else {
+			tc.transports[i].Disconnect(other.LocalAddr())
+			other.Disconnect(tc.transports[i].LocalAddr())
+		}
+	}
+}
+
+// leader waits for one of the nodes not in excluded to become leader
+func (tc *testCluster) leader(t *testing.T, excluded ...int) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, node := range tc.nodes {
+			if node.raft.State() == raft.Leader && !containsInt(excluded, i) {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return -1
+}
+
+func containsInt(list []int, n int) bool {
+	for _, member := range list {
+		if member == n {
+			return true
+		}
+	}
+	return false
+}
+
+// converged waits for every store to have the same count records
+func (tc *testCluster) converged(t *testing.T, count int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for i, store := range tc.stores {
+		for len(store.recordsSoFar()) < count {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d has %d records, wanted %d", i, len(store.recordsSoFar()), count)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !reflect.DeepEqual(store.recordsSoFar(), tc.stores[0].recordsSoFar()) {
+			t.Errorf("node %d has different records", i)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	for _, size := range []int{3, 5} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) { clusterScenarios(t, size) })
+	}
+}
+
+func clusterScenarios(t *testing.T, size int) {
+	rememberTimeout := ClusterApplyTimeout
+	ClusterApplyTimeout = 500 * time.Millisecond
+	defer func() { ClusterApplyTimeout = rememberTimeout }()
+	tc := newTestCluster(t, size)
+	defer tc.shutdown()
+
+	leader := tc.leader(t)
+	follower := (leader + 1) % size
+	records := 0
+	claim := func(node int, bid string, pid string) error {
+		return tc.stores[node].append(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{pid}})
+	}
+
+	// an append on the leader reaches everyone
+	record := LedgerRecord{RecType: ClaimBID, BID: "00000000000f0001", PIDs: []string{"Twitter.com@Raft1"}}
+	err := tc.stores[leader].append(&record)
+	if err != nil {
+		t.Fatal("claim: " + err.Error())
+	}
+	records++
+	if record.Sequence != 0 || record.Hash == "" || record.PIDs[0] != "twitter.com@raft1" {
+		t.Error("caller didn't get the committed record back")
+	}
+	tc.converged(t, records)
+	for i, store := range tc.stores {
+		if !store.isMapped("00000000000F0001", "twitter.com@raft1") {
+			t.Errorf("node %d doesn't have the claim", i)
+		}
+	}
+
+	// of many claims of one BID, exactly one wins, everywhere
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := claim(leader, "00000000000f0002", "twitter.com@racer"+strconv.Itoa(i))
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			} else if !strings.Contains(err.Error(), "already been claimed") {
+				t.Error("unexpected: " + err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("%d claims of the same BID accepted", accepted)
+	}
+	records++
+	tc.converged(t, records)
+	for i, store := range tc.stores {
+		if len(store.pidsForBID("00000000000F0002")) != 1 {
+			t.Errorf("node %d has conflicting claims", i)
+		}
+	}
+
+	// followers don't take appends, and send writes to the leader
+	err = claim(follower, "00000000000f0003", "twitter.com@raft3")
+	if _, ok := err.(*ClusterUnavailableError); !ok {
+		t.Errorf("follower took an append: %v", err)
+	}
+	w := httptest.NewRecorder()
+	tc.nodes[follower].LeaderOnly(ClaimBIDHandler)(w, httptest.NewRequest("POST", "/claim-bid?x=1", nil))
+	if w.Code != 307 || w.Header().Get("Location") != "http://node"+strconv.Itoa(leader)+"/claim-bid?x=1" {
+		t.Errorf("follower didn't redirect: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// cut off the leader: the rest carry on without it, and it can't commit anything by itself
+	tc.isolate(leader, false)
+	newLeader := tc.leader(t, leader)
+	err = claim(newLeader, "00000000000f0004", "twitter.com@raft4")
+	if err != nil {
+		t.Fatal("claim after failover: " + err.Error())
+	}
+	records++
+	err = claim(leader, "00000000000f0004", "twitter.com@split")
+	if _, ok := err.(*ClusterUnavailableError); !ok {
+		t.Errorf("isolated leader didn't fail: %v", err)
+	}
+
+	// when it comes back, it catches up, and whatever it tried by itself is gone
+	tc.isolate(leader, true)
+	tc.converged(t, records)
+	for i, store := range tc.stores {
+		if store.isMapped("00000000000F0004", "twitter.com@split") {
+			t.Errorf("node %d has the split-brain claim", i)
+		}
+	}
+
+	// without a quorum, nothing commits
+	current := tc.leader(t)
+	var cutOff []int
+	for i := 0; len(cutOff) < (size+1)/2; i++ {
+		if i != current {
+			tc.isolate(i, false)
+			cutOff = append(cutOff, i)
+		}
+	}
+	err = claim(current, "00000000000f0005", "twitter.com@raft5")
+	if _, ok := err.(*ClusterUnavailableError); !ok {
+		t.Errorf("append without quorum didn't fail: %v", err)
+	}
+}
+
+// TestClusterBIDReuse checks that the leader applies BIDReuse, which followers don't know about
+func TestClusterBIDReuse(t *testing.T) {
+	defer func(policy BIDReusePolicy) { BIDReuse = policy }(BIDReuse)
+	BIDReuse = BIDReusePolicy{}
+	tc := newTestCluster(t, 3)
+	defer tc.shutdown()
+
+	leader := tc.leader(t)
+	bid := "00000000000f0101"
+	for _, recType := range []recordType{ClaimBID, UnclaimBID} {
+		err := tc.stores[leader].append(&LedgerRecord{RecType: recType, BID: bid, PIDs: []string{"twitter.com@reuse1"}})
+		if err != nil {
+			t.Fatal(recTypeNames[recType] + ": " + err.Error())
+		}
+	}
+	err := tc.stores[leader].append(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{"twitter.com@reuse2"}})
+	if err == nil || !strings.Contains(err.Error(), "retired") {
+		t.Errorf("tombstoned BID reclaimed: %v", err)
+	}
+	tc.converged(t, 2)
+
+	BIDReuse = BIDReusePolicy{Allowed: true}
+	err = tc.stores[leader].append(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{"twitter.com@reuse2"}})
+	if err != nil {
+		t.Fatal("reclaim under 'always': " + err.Error())
+	}
+	tc.converged(t, 3)
+	for i, store := range tc.stores {
+		if !store.isMapped("00000000000F0101", "twitter.com@reuse2") {
+			t.Errorf("node %d doesn't have the reclaim", i)
+		}
+	}
+}
+
+// TestClusterWebhooks checks that each append is announced once, by the leader that took it, and not again by the
+// followers that apply it or by a server that restores a snapshot
+func TestClusterWebhooks(t *testing.T) {
+	hook, restoreHooks := queueingWebhook()
+	defer restoreHooks()
+	tc := newTestCluster(t, 3)
+	defer tc.shutdown()
+	for _, store := range tc.stores {
+		// each of them would be theStore on its own server
+		store.lock.Lock()
+		serverStore(store)
+		store.lock.Unlock()
+	}
+
+	leader := tc.leader(t)
+	for i := 0; i < 3; i++ {
+		err := tc.stores[leader].append(&LedgerRecord{RecType: ClaimBID, BID: fmt.Sprintf("%x", 0xf200+i), PIDs: []string{"twitter.com@hook"}})
+		if err != nil {
+			t.Fatal("claim: " + err.Error())
+		}
+	}
+	if tc.stores[leader].append(&LedgerRecord{RecType: ClaimBID, BID: "f200", PIDs: []string{"reddit.com@hook"}}) == nil {
+		t.Error("BID claimed twice")
+	}
+	tc.converged(t, 3)
+
+	snapshot, _ := (*clusterFSM)(tc.stores[leader]).Snapshot()
+	var sink bufferSink
+	_ = snapshot.Persist(&sink)
+	err := (*clusterFSM)(serverStore(newLedgerStore())).Restore(io.NopCloser(strings.NewReader(sink.String())))
+	if err != nil {
+		t.Fatal("restore: " + err.Error())
+	}
+
+	if len(hook.events) != 3 {
+		t.Fatalf("%d events for 3 appends", len(hook.events))
+	}
+	for i := 0; i < 3; i++ {
+		if event := <-hook.events; event.Sequence != i || event.Record.BID != FormatBID(uint64(0xf200+i)) {
+			t.Errorf("event %d is %+v", i, event)
+		}
+	}
+}
+
+// TestClusterReverify checks that only the leader re-verifies
+func TestClusterReverify(t *testing.T) {
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+	rememberFlags := reverifyFlags
+	reverifyFlags = make(map[int]*ReverifyFlag)
+	defer func() { reverifyFlags = rememberFlags }()
+	defer func(s *ledgerStore) { theStore = s }(theStore)
+	tc := newTestCluster(t, 3)
+	defer tc.shutdown()
+
+	leader := tc.leader(t)
+	err := tc.stores[leader].append(&LedgerRecord{RecType: ClaimBID, BID: "00000000000f0201", PIDs: []string{"twitter.com@rvc"},
+		PostURLs: []string{"https://example.com/rvc-gone"}})
+	if err != nil {
+		t.Fatal("claim: " + err.Error())
+	}
+	tc.converged(t, 1)
+
+	theStore = tc.stores[(leader+1)%3]
+	for i := 0; i < ReverifyStrikes; i++ {
+		reverifyLedger(ReverifyAutoUnclaim)
+	}
+	if len(reverifyFlags) != 0 {
+		t.Error("follower re-verified")
+	}
+	theStore = tc.stores[leader]
+	reverifyLedger(ReverifyFlagOnly)
+	if len(reverifyFlags) != 1 {
+		t.Error("leader didn't re-verify")
+	}
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestClusterSnapshot(t *testing.T) {
+	from := newLedgerStore()
+	for i := 0; i < 5; i++ {
+		err := from.append(&LedgerRecord{RecType: ClaimBID, BID: fmt.Sprintf("%x", 0xf100+i), PIDs: []string{"twitter.com@snap"}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := from.append(&LedgerRecord{RecType: GrantBID, BID: "f100", PIDs: []string{"twitter.com@snap", "reddit.com@snap"}, Key: newPubKey()})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snapshot, _ := (*clusterFSM)(from).Snapshot()
+	var sink bufferSink
+	err = snapshot.Persist(&sink)
+	if err != nil {
+		t.Fatal("persist: " + err.Error())
+	}
+	saved := sink.String()
+
+	to := newLedgerStore()
+	_ = to.append(&LedgerRecord{RecType: ClaimBID, BID: "dead", PIDs: []string{"twitter.com@gone"}})
+	err = (*clusterFSM)(to).Restore(io.NopCloser(strings.NewReader(saved)))
+	if err != nil {
+		t.Fatal("restore: " + err.Error())
+	}
+	if !reflect.DeepEqual(to.recordsSoFar(), from.recordsSoFar()) || !reflect.DeepEqual(to.mappings, from.mappings) ||
+		!reflect.DeepEqual(to.keysUsed, from.keysUsed) {
+		t.Error("restored store doesn't match")
+	}
+
+	tampered := strings.Replace(saved, "reddit.com@snap", "reddit.com@evil", 1)
+	err = (*clusterFSM)(newLedgerStore()).Restore(io.NopCloser(strings.NewReader(tampered)))
+	if err == nil {
+		t.Error("restored tampered snapshot")
+	}
+}
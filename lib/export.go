@@ -0,0 +1,228 @@
+package blueskidgo
+
+// Moving a ledger from one server to another, or into an archive. An export is every record in order, either as
+//  JSON Lines or as a CBOR sequence (RFC 8742) in the deterministic encoding of RFC 8949 §4.2, so that the same
+//  ledger always exports to the same bytes. After the records comes a trailer with the record count and the
+//  SHA-256 of everything before it, so a truncated or damaged file is spotted. Importing checks the trailer, then
+//  replays every record through the same checks appendToLedger applies, and takes nothing unless they all pass.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	ExportJSONLines = "jsonl"
+	ExportCBOR      = "cbor"
+)
+
+type exportTrailer struct {
+	Count  int
+	Digest string
+}
+
+// exportItem is what each item in an export decodes into: a record or, if Digest is set, the trailer
+type exportItem struct {
+	LedgerRecord
+	Count  int    `json:",omitempty" cbor:",omitempty"`
+	Digest string `json:",omitempty" cbor:",omitempty"`
+}
+
+var cborEncoding = func() cbor.EncMode {
+	options := cbor.CoreDetEncOptions()
+	options.Time = cbor.TimeRFC3339Nano
+	mode, err := options.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// in CBOR too, record types are written as names, and numbers are still read
+func (t recordType) MarshalCBOR() ([]byte, error) {
+	name, ok := recTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d", int(t))
+	}
+	return cborEncoding.Marshal(name)
+}
+
+func (t *recordType) UnmarshalCBOR(b []byte) error {
+	var v interface{}
+	err := cbor.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		return t.setFromName(v)
+	case uint64:
+		if v < uint64(len(recTypeNames)) {
+			return t.setFromNumber(int(v))
+		}
+	}
+	return errors.New("record type must be a name or a number")
+}
+
+func exportDigest(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+// exportLedger writes records in format, then the trailer
+func exportLedger(w io.Writer, records []*LedgerRecord, format string) error {
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+	encode := func(v interface{}) error {
+		if format == ExportCBOR {
+			return cborEncoding.NewEncoder(out).Encode(v)
+		}
+		return json.NewEncoder(out).Encode(v)
+	}
+	for _, record := range records {
+		err := encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	return encode(&exportTrailer{Count: len(records), Digest: exportDigest(hash.Sum(nil))})
+}
+
+// LedgerExportHandler serves /ledger/export, with format=jsonl (the default) or format=cbor
+func LedgerExportHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	format := httpRequest.Form.Get("format")
+	switch format {
+	case "", ExportJSONLines:
+		format = ExportJSONLines
+		w.Header().Set("Content-type", "application/jsonl")
+	case ExportCBOR:
+		w.Header().Set("Content-type", "application/cbor-seq")
+	default:
+		http.Error(w, "parameter 'format' must be 'jsonl' or 'cbor'", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=ledger."+format)
+	w.WriteHeader(http.StatusOK)
+	_ = exportLedger(w, storeFor(httpRequest).recordsSoFar(), format)
+}
+
+// readExport parses an export in either format, which it works out from the first byte, and checks the trailer
+func readExport(data []byte) ([]*LedgerRecord, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 {
+		return nil, errors.New("export is empty")
+	}
+	next := nextJSONLine
+	if trimmed[0] != '{' {
+		next = nextCBORItem
+	}
+
+	var records []*LedgerRecord
+	rest := data
+	for len(rest) > 0 {
+		start := len(data) - len(rest)
+		var item exportItem
+		var err error
+		rest, err = next(rest, &item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %s", len(records), err.Error())
+		}
+		if item.Digest == "" {
+			record := item.LedgerRecord
+			records = append(records, &record)
+			continue
+		}
+
+		if len(bytes.TrimSpace(rest)) != 0 {
+			return nil, errors.New("there's more after the trailer")
+		}
+		sum := sha256.Sum256(data[:start])
+		if item.Digest != exportDigest(sum[:]) {
+			return nil, errors.New("digest doesn't match; the export has been damaged")
+		}
+		if item.Count != len(records) {
+			return nil, fmt.Errorf("trailer says %d records, found %d", item.Count, len(records))
+		}
+		return records, nil
+	}
+	return nil, errors.New("no trailer; the export is incomplete")
+}
+
+func nextJSONLine(data []byte, item *exportItem) ([]byte, error) {
+	line := data
+	rest := []byte(nil)
+	i := bytes.IndexByte(data, '\n')
+	if i >= 0 {
+		line, rest = data[:i], data[i+1:]
+	}
+	return rest, json.Unmarshal(line, item)
+}
+
+func nextCBORItem(data []byte, item *exportItem) ([]byte, error) {
+	return cbor.UnmarshalFirst(data, item)
+}
+
+// importLedger replays records into s, which must be empty. Every record has to be the next one, chain on to the
+// ones before it, and pass the append checks; if any doesn't, s is left empty.
+func (s *ledgerStore) importLedger(records []*LedgerRecord) error {
+	if s.cluster != nil {
+		return errors.New("can't import into a cluster")
+	}
+
+	// try it out on a scratch store first, so that nothing gets into s unless it all works; being scratch, it
+	// doesn't announce anything, and nor does s, since the records are replicated rather than appended
+	scratch := newLedgerStore()
+	for _, record := range records {
+		copied := *record
+		err := scratch.replicate(&copied)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.records) != 0 {
+		return errors.New("can only import into an empty ledger")
+	}
+	for _, record := range records {
+		txn, err := s.begin(record, record.When)
+		if err != nil {
+			return err
+		}
+		txn.replicated = true
+		err = txn.run()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportLedger reads an export, in either format, into theStore, which must be empty. It returns the number of
+// records imported.
+func ImportLedger(r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	records, err := readExport(data)
+	if err != nil {
+		return 0, errors.New("can't import: " + err.Error())
+	}
+	err = theStore.importLedger(records)
+	if err != nil {
+		return 0, errors.New("can't import: " + err.Error())
+	}
+	return len(records), nil
+}
@@ -0,0 +1,186 @@
+package blueskidgo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func exportForTest(t *testing.T, format string) []byte {
+	w := httptest.NewRecorder()
+	LedgerExportHandler(w, httptest.NewRequest("GET", "/ledger/export?format="+format, nil))
+	if w.Code != 200 {
+		t.Fatal("export failed: " + w.Body.String())
+	}
+	return w.Body.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	defer freshLedger()()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "ee01", PIDs: []string{"twitter.com@ex1"}, PostURLs: []string{"https://example.com/c"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "ee01", PIDs: []string{"twitter.com@ex1", "reddit.com@ex2"}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "ee01", PIDs: []string{"twitter.com@ex1"}})
+	original := theStore.recordsSoFar()
+	if len(original) != 3 {
+		t.Fatal("setup failed")
+	}
+
+	for _, format := range []string{ExportJSONLines, ExportCBOR} {
+		exported := exportForTest(t, format)
+		if !bytes.Equal(exportForTest(t, format), exported) {
+			t.Error(format + ": export isn't deterministic")
+		}
+
+		restore := freshLedger()
+		count, err := ImportLedger(bytes.NewReader(exported))
+		if err != nil || count != 3 {
+			t.Errorf("%s: import: %v", format, err)
+		} else if !reflect.DeepEqual(theStore.recordsSoFar(), original) {
+			t.Error(format + ": imported ledger differs")
+		}
+		if !theStore.isMapped("000000000000EE01", "reddit.com@ex2") {
+			t.Error(format + ": mappings not rebuilt")
+		}
+		_, err = ImportLedger(bytes.NewReader(exported))
+		if err == nil {
+			t.Error(format + ": imported into a non-empty ledger")
+		}
+		restore()
+	}
+}
+
+func TestImportRejections(t *testing.T) {
+	defer freshLedger()()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "ee02", PIDs: []string{"twitter.com@ex3"}})
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "ee03", PIDs: []string{"twitter.com@ex4"}})
+	records := theStore.recordsSoFar()
+	good := exportForTest(t, ExportJSONLines)
+	lines := strings.SplitAfter(string(good), "\n")
+
+	// a record that breaks the rules, hashed and digested properly so that only the rules can catch it
+	illegal := LedgerRecord{RecType: ClaimBID, BID: records[0].BID, PIDs: []string{"twitter.com@ex5"}, Sequence: 2, When: records[1].When}
+	illegal.Hash = recordHash(records[1].Hash, &illegal)
+	var withIllegal bytes.Buffer
+	_ = exportLedger(&withIllegal, append(records, &illegal), ExportJSONLines)
+
+	// a record that's been changed, with the digest fixed up to match
+	changed := *records[1]
+	changed.PIDs = []string{"twitter.com@mallory"}
+	var withChanged bytes.Buffer
+	_ = exportLedger(&withChanged, []*LedgerRecord{records[0], &changed}, ExportJSONLines)
+
+	body := lines[0] + lines[1]
+	sum := sha256.Sum256([]byte(body))
+	wrongCount, _ := json.Marshal(&exportTrailer{Count: 5, Digest: exportDigest(sum[:])})
+
+	hook, restoreHooks := queueingWebhook()
+	defer restoreHooks()
+	for _, reject := range []struct {
+		what   string
+		export string
+	}{
+		{"empty", ""},
+		{"no trailer", lines[0] + lines[1]},
+		{"damaged", strings.Replace(string(good), "ex4", "ex6", 1)},
+		{"stuff after trailer", string(good) + lines[0]},
+		{"wrong count", body + string(wrongCount) + "\n"},
+		{"garbage", "\xa1\x01"},
+		{"rule-breaking record", withIllegal.String()},
+		{"changed record", withChanged.String()},
+	} {
+		restore := freshLedger()
+		_, err := ImportLedger(strings.NewReader(reject.export))
+		if err == nil {
+			t.Error(reject.what + ": imported")
+		}
+		if len(theStore.recordsSoFar()) != 0 || len(theStore.mappings.PIDsForBID) != 0 {
+			t.Error(reject.what + ": partly imported")
+		}
+		if len(hook.events) != 0 {
+			t.Errorf("%s: %d webhook events", reject.what, len(hook.events))
+		}
+		restore()
+	}
+
+	// nor does a successful import announce anything; the records weren't appended here
+	restore := freshLedger()
+	defer restore()
+	_, err := ImportLedger(bytes.NewReader(good))
+	if err != nil || len(hook.events) != 0 {
+		t.Errorf("import: %v, %d webhook events", err, len(hook.events))
+	}
+}
+
+func TestRecordTypeEncoding(t *testing.T) {
+	for recType, name := range recTypeNames {
+		b, err := json.Marshal(recType)
+		if err != nil || string(b) != `"`+name+`"` {
+			t.Errorf("%d marshals to %s", int(recType), b)
+		}
+		for _, encoded := range []string{`"` + name + `"`, fmt.Sprint(int(recType))} {
+			var decoded recordType
+			err = json.Unmarshal([]byte(encoded), &decoded)
+			if err != nil || decoded != recType {
+				t.Errorf("%s unmarshals to %d: %v", encoded, int(decoded), err)
+			}
+		}
+	}
+	for _, bad := range []string{`"Steal"`, "7", "-1", "1.5", "null", "true"} {
+		var decoded recordType
+		if json.Unmarshal([]byte(bad), &decoded) == nil {
+			t.Error("unmarshaled " + bad)
+		}
+	}
+}
+
+// TestImportNumericTypes imports exports written before record types were names
+func TestImportNumericTypes(t *testing.T) {
+	defer freshLedger()()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "ee04", PIDs: []string{"twitter.com@ex7"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "ee04", PIDs: []string{"twitter.com@ex7", "reddit.com@ex8"}, Key: newPubKey()})
+	original := theStore.recordsSoFar()
+
+	// JSON Lines, with the types as numbers and the digest fixed up to match
+	lines := strings.SplitAfter(string(exportForTest(t, ExportJSONLines)), "\n")
+	body := ""
+	for i, line := range lines[:len(original)] {
+		body += strings.Replace(line, `"RecType":"`+recTypeNames[original[i].RecType]+`"`,
+			`"RecType":`+fmt.Sprint(int(original[i].RecType)), 1)
+	}
+	if strings.Contains(body, `"RecType":"`) {
+		t.Fatal("setup failed")
+	}
+	sum := sha256.Sum256([]byte(body))
+	trailer, _ := json.Marshal(&exportTrailer{Count: len(original), Digest: exportDigest(sum[:])})
+	old := body + string(trailer) + "\n"
+
+	// CBOR, with the types as numbers
+	var oldCBOR bytes.Buffer
+	hash := sha256.New()
+	out := io.MultiWriter(&oldCBOR, hash)
+	for _, record := range original {
+		fields := map[string]interface{}{
+			"Sequence": record.Sequence, "RecType": int(record.RecType), "BID": record.BID, "PIDs": record.PIDs,
+			"PostURLs": record.PostURLs, "Key": record.Key, "When": record.When, "Hash": record.Hash,
+		}
+		_ = cborEncoding.NewEncoder(out).Encode(fields)
+	}
+	_ = cborEncoding.NewEncoder(&oldCBOR).Encode(&exportTrailer{Count: len(original), Digest: exportDigest(hash.Sum(nil))})
+
+	for format, export := range map[string][]byte{ExportJSONLines: []byte(old), ExportCBOR: oldCBOR.Bytes()} {
+		restore := freshLedger()
+		_, err := ImportLedger(bytes.NewReader(export))
+		if err != nil {
+			t.Errorf("%s: import: %v", format, err)
+		} else if !reflect.DeepEqual(theStore.recordsSoFar(), original) {
+			t.Error(format + ": imported ledger differs")
+		}
+		restore()
+	}
+}
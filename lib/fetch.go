@@ -0,0 +1,211 @@
+package blueskidgo
+
+// All fetching from providers goes through fetchURL. Responses are kept in a bounded LRU cache; for a little
+//  while a cached response is used as is, and after that it's revalidated with If-None-Match or If-Modified-Since,
+//  so that re-fetching a post that hasn't changed costs the provider very little. Each request has a timeout, and
+//  each response a size cap, which can be set per host. Requests are rate-limited per host, see ratelimit.go.
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	goURL "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FetchLimits bound a request to a provider
+type FetchLimits struct {
+	Timeout  time.Duration
+	MaxBytes int64
+}
+
+// DefaultFetchLimits apply to hosts that aren't in HostFetchLimits
+var DefaultFetchLimits = FetchLimits{Timeout: 10 * time.Second, MaxBytes: 2 << 20}
+
+// HostFetchLimits is indexed by hostname
+var HostFetchLimits = map[string]FetchLimits{
+	"api.twitter.com": {Timeout: 10 * time.Second, MaxBytes: 256 << 10},
+}
+
+// FetchCacheSize is how many responses the cache holds
+var FetchCacheSize = 1000
+
+// FetchFreshFor is how long a cached response is used without revalidating it
+var FetchFreshFor = time.Minute
+
+var fetchClient = &http.Client{}
+
+// PostGoneError means the provider says the post isn't there, with a 404 or 410
+type PostGoneError struct {
+	URL    string
+	Status int
+}
+
+func (e *PostGoneError) Error() string {
+	return fmt.Sprintf("GET %s: %d %s", e.URL, e.Status, http.StatusText(e.Status))
+}
+
+type cachedResponse struct {
+	url          string
+	body         []byte
+	etag         string
+	lastModified string
+	validated    time.Time
+}
+
+// fetchCache is an LRU cache of responses, indexed by URL; the front of order is the most recently used
+type fetchCache struct {
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+var responseCache = newFetchCache()
+
+func newFetchCache() *fetchCache {
+	return &fetchCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *fetchCache) get(url string) *cachedResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	cached := *element.Value.(*cachedResponse)
+	return &cached
+}
+
+func (c *fetchCache) put(cached *cachedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[cached.url]; ok {
+		element.Value = cached
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[cached.url] = c.order.PushFront(cached)
+	}
+	for c.order.Len() > FetchCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).url)
+	}
+}
+
+func (c *fetchCache) remove(url string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[url]; ok {
+		c.order.Remove(element)
+		delete(c.entries, url)
+	}
+}
+
+func fetchLimitsFor(host string) FetchLimits {
+	limits, ok := HostFetchLimits[host]
+	if !ok {
+		return DefaultFetchLimits
+	}
+	return limits
+}
+
+// fetchURL GETs url, with header added to the request, and returns the body of a 200 response, possibly from the
+// cache
+func fetchURL(url string, header http.Header) ([]byte, error) {
+	parsed, err := goURL.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	cached := responseCache.get(url)
+	if cached != nil && time.Since(cached.validated) < FetchFreshFor {
+		return cached.body, nil
+	}
+
+	host := parsed.Hostname()
+	limits := fetchLimitsFor(host)
+	limiter := limiterFor(host)
+	for attempt := 1; ; attempt++ {
+		wait, ok := limiter.reserve(time.Now(), MaxThrottleWait)
+		if !ok {
+			return nil, &UpstreamThrottledError{Host: host, RetryAfter: wait}
+		}
+		time.Sleep(wait)
+
+		status, respHeader, body, err := fetchOnce(url, header, cached, limits)
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusTooManyRequests || status >= 500 {
+			backoff := limiter.failed(time.Now(), respHeader)
+			if attempt < FetchAttempts && backoff <= MaxThrottleWait {
+				continue
+			}
+			return nil, &UpstreamThrottledError{Host: host, Status: status, RetryAfter: backoff}
+		}
+		limiter.succeeded(time.Now(), respHeader)
+
+		if status == http.StatusNotModified && cached != nil {
+			cached.validated = time.Now()
+			responseCache.put(cached)
+			return cached.body, nil
+		}
+		if status != http.StatusOK {
+			// a post that's gone shouldn't be served from the cache
+			responseCache.remove(url)
+			if status == http.StatusNotFound || status == http.StatusGone {
+				return nil, &PostGoneError{URL: url, Status: status}
+			}
+			return nil, fmt.Errorf("GET %s: %d %s", url, status, http.StatusText(status))
+		}
+		if strings.Contains(respHeader.Get("Cache-Control"), "no-store") {
+			responseCache.remove(url)
+		} else {
+			responseCache.put(&cachedResponse{url: url, body: body, etag: respHeader.Get("ETag"),
+				lastModified: respHeader.Get("Last-Modified"), validated: time.Now()})
+		}
+		return body, nil
+	}
+}
+
+// fetchOnce makes one request, revalidating cached if there is one, and returns the response's status, headers,
+// and body
+func fetchOnce(url string, header http.Header, cached *cachedResponse, limits FetchLimits) (int, http.Header, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, nil, nil, errors.New("Failed to create request: " + err.Error())
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, errors.New("GET failed: " + err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limits.MaxBytes+1))
+	if err != nil {
+		return 0, nil, nil, errors.New("reading response failed: " + err.Error())
+	}
+	if int64(len(body)) > limits.MaxBytes {
+		return 0, nil, nil, fmt.Errorf("response from %s is larger than %d bytes", req.URL.Hostname(), limits.MaxBytes)
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
@@ -0,0 +1,158 @@
+package blueskidgo
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freshFetchCache swaps in an empty cache whose entries are always stale, so every fetch goes to the server, and
+// new rate limiters. Call the returned func to put things back.
+func freshFetchCache() func() {
+	savedCache, savedFresh, savedSize, savedLimiters := responseCache, FetchFreshFor, FetchCacheSize, hostLimiters
+	responseCache = newFetchCache()
+	FetchFreshFor = 0
+	hostLimiters = make(map[string]*hostLimiter)
+	return func() {
+		responseCache, FetchFreshFor, FetchCacheSize, hostLimiters = savedCache, savedFresh, savedSize, savedLimiters
+	}
+}
+
+func TestFetchRevalidation(t *testing.T) {
+	defer freshFetchCache()()
+	var requests, notModified int32
+	text := "first"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		etag := `"` + text + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(text))
+	}))
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		body, err := fetchURL(server.URL+"/post", nil)
+		if err != nil || string(body) != "first" {
+			t.Fatalf("fetch %d: %q %v", i, body, err)
+		}
+	}
+	if requests != 3 || notModified != 2 {
+		t.Errorf("%d requests, %d not modified", requests, notModified)
+	}
+
+	// an edited post is fetched anew
+	text = "second"
+	body, _ := fetchURL(server.URL+"/post", nil)
+	if string(body) != "second" {
+		t.Errorf("edit not seen: %q", body)
+	}
+
+	// while it's fresh, the server isn't asked at all
+	FetchFreshFor = time.Hour
+	_, _ = fetchURL(server.URL+"/post", nil)
+	if requests != 4 {
+		t.Errorf("fresh response revalidated: %d requests", requests)
+	}
+}
+
+func TestFetchLastModified(t *testing.T) {
+	defer freshFetchCache()()
+	modified := time.Date(2021, 9, 20, 17, 42, 5, 0, time.UTC).Format(http.TimeFormat)
+	var conditional int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == modified {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", modified)
+		_, _ = w.Write([]byte("post"))
+	}))
+	defer server.Close()
+
+	_, _ = fetchURL(server.URL, nil)
+	body, err := fetchURL(server.URL, nil)
+	if err != nil || string(body) != "post" || conditional != 1 {
+		t.Errorf("If-Modified-Since: %q %v %d", body, err, conditional)
+	}
+}
+
+func TestFetchFailures(t *testing.T) {
+	defer freshFetchCache()()
+	gone := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			_, _ = w.Write([]byte(strings.Repeat("x", 2000)))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte("late"))
+		case "/header":
+			_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+		default:
+			if gone {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("ETag", `"x"`)
+			_, _ = w.Write([]byte("here"))
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	host = host[:strings.Index(host, ":")]
+	HostFetchLimits[host] = FetchLimits{Timeout: 50 * time.Millisecond, MaxBytes: 1000}
+	defer delete(HostFetchLimits, host)
+
+	_, err := fetchURL(server.URL+"/big", nil)
+	if err == nil || !strings.Contains(err.Error(), "larger than 1000 bytes") {
+		t.Errorf("size cap: %v", err)
+	}
+	_, err = fetchURL(server.URL+"/slow", nil)
+	if err == nil {
+		t.Error("timeout not applied")
+	}
+	body, err := fetchURL(server.URL+"/header", http.Header{"Authorization": {"Bearer t"}})
+	if err != nil || string(body) != "Bearer t" {
+		t.Errorf("header not sent: %q %v", body, err)
+	}
+
+	// a deleted post isn't served from the cache
+	_, _ = fetchURL(server.URL+"/post", nil)
+	gone = true
+	_, err = fetchURL(server.URL+"/post", nil)
+	var postGone *PostGoneError
+	if !errors.As(err, &postGone) || postGone.Status != http.StatusNotFound || !strings.Contains(err.Error(), "404") {
+		t.Errorf("deleted post: %v", err)
+	}
+	FetchFreshFor = time.Hour
+	_, err = fetchURL(server.URL+"/post", nil)
+	if err == nil {
+		t.Error("deleted post served from the cache")
+	}
+}
+
+func TestFetchCacheEviction(t *testing.T) {
+	defer freshFetchCache()()
+	FetchCacheSize = 2
+	c := responseCache
+	for _, url := range []string{"a", "b", "c"} {
+		c.put(&cachedResponse{url: url})
+		if url == "b" {
+			c.get("a")
+		}
+	}
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil || c.order.Len() != 2 {
+		t.Error("least recently used entry not evicted")
+	}
+}
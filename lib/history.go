@@ -0,0 +1,82 @@
+package blueskidgo
+
+// the Claim/Grant/Unclaim/Revoke records that led to a BID or PID's current mappings, for when those are disputed
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type historyResponse struct {
+	BID     string `json:",omitempty"`
+	PID     string `json:",omitempty"`
+	History []*LedgerRecord
+
+	// the keys of any Grants in History that have been revoked
+	RevokedKeys []string `json:",omitempty"`
+}
+
+// history returns, in ledger order, every record that matches the filter. Each record's Sequence gives its
+// position in the ledger.
+func (s *ledgerStore) history(filter *LedgerFilter) ([]*LedgerRecord, error) {
+	var collector recordCollector
+	_, err := s.scanRange(&collector, filter, -1, 0)
+	if collector.records == nil {
+		collector.records = []*LedgerRecord{}
+	}
+	return collector.records, err
+}
+
+func BIDHistoryHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	bid := httpRequest.Form.Get("bid")
+	if bid == "" {
+		http.Error(w, "missing parameter 'bid'", http.StatusBadRequest)
+		return
+	}
+	bid, err := NormalizeBID(bid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'bid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := storeFor(httpRequest)
+	resp := historyResponse{BID: bid}
+	resp.History, err = s.history(&LedgerFilter{BID: bid})
+	if err != nil {
+		http.Error(w, "ledger scan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.RevokedKeys = s.revokedKeysAmong(resp.History)
+	respJSON, err := json.MarshalIndent(resp, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+func PIDHistoryHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	pid := httpRequest.Form.Get("pid")
+	if pid == "" {
+		http.Error(w, "missing parameter 'pid'", http.StatusBadRequest)
+		return
+	}
+	pid, err := NormalizePID(pid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'pid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := storeFor(httpRequest)
+	resp := historyResponse{PID: pid}
+	resp.History, err = s.history(&LedgerFilter{PID: pid})
+	if err != nil {
+		http.Error(w, "ledger scan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.RevokedKeys = s.revokedKeysAmong(resp.History)
+	respJSON, err := json.MarshalIndent(resp, "", " ")
+	writeJson(w, respJSON, err)
+}
@@ -0,0 +1,62 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	defer freshLedger()()
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "4150", PIDs: []string{"twitter.com@h1"}})
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "4151", PIDs: []string{"twitter.com@h2"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "4150", PIDs: []string{"twitter.com@h1", "twitter.com@h2"}, Key: newPubKey()})
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "4150", PIDs: []string{"twitter.com@h1"}})
+
+	w := httptest.NewRecorder()
+	BIDHistoryHandler(w, httptest.NewRequest("GET", "/bid-history?bid=4150", nil))
+	var resp historyResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal("bad JSON: " + w.Body.String())
+	}
+	if resp.BID != "0000000000004150" || len(resp.History) != 3 {
+		t.Error("wrong BID history")
+	}
+	for i, wanted := range []int{0, 2, 3} {
+		if resp.History[i].Sequence != wanted {
+			t.Error("BID history out of order or missing positions")
+		}
+	}
+
+	w = httptest.NewRecorder()
+	PIDHistoryHandler(w, httptest.NewRequest("GET", "/pid-history?pid=Twitter.com@H2", nil))
+	resp = historyResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.PID != "twitter.com@h2" || len(resp.History) != 2 || resp.History[0].Sequence != 1 || resp.History[1].Sequence != 2 {
+		t.Error("wrong PID history: " + w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	PIDHistoryHandler(w, httptest.NewRequest("GET", "/pid-history?pid=twitter.com@nobody", nil))
+	if w.Code != 200 || w.Body.String() == "" {
+		t.Error("empty history failed")
+	}
+	resp = historyResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.History == nil || len(resp.History) != 0 {
+		t.Error("empty history should be an empty list")
+	}
+
+	w = httptest.NewRecorder()
+	BIDHistoryHandler(w, httptest.NewRequest("GET", "/bid-history", nil))
+	if w.Code != 400 {
+		t.Error("accepted missing bid")
+	}
+	w = httptest.NewRecorder()
+	PIDHistoryHandler(w, httptest.NewRequest("GET", "/pid-history?pid=bogus", nil))
+	if w.Code != 400 {
+		t.Error("accepted bogus pid")
+	}
+}
@@ -0,0 +1,110 @@
+package blueskidgo
+
+// parsing, validation, and normalization of BIDs and PIDs.  Everything that accepts a BID or PID from the outside
+//  world - an HTTP request, a social-media post, an assertion - should push it through here, so that the same
+//  identity always ends up as the same string in the ledger and the mapping tables.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ParseBID accepts a BID in hex, case-insensitive, with or without leading zeroes.
+func ParseBID(s string) (uint64, error) {
+	if s == "" {
+		return 0, errors.New("empty BID")
+	}
+	if len(s) > 16 {
+		return 0, errors.New("BID '" + s + "' is longer than 16 hex digits")
+	}
+	bid, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, errors.New("BID '" + s + "' is not a hex 64-bit quantity")
+	}
+	return bid, nil
+}
+
+// FormatBID produces the canonical representation: 16 upper-case hex digits
+func FormatBID(bid uint64) string {
+	return fmt.Sprintf("%016X", bid)
+}
+
+// NormalizeBID round-trips a BID string through ParseBID and FormatBID
+func NormalizeBID(s string) (string, error) {
+	bid, err := ParseBID(s)
+	if err != nil {
+		return "", err
+	}
+	return FormatBID(bid), nil
+}
+
+// PID is a Provider Identity, written provider@user, e.g. twitter.com@timbray
+type PID struct {
+	Provider string
+	User     string
+}
+
+func (p PID) String() string {
+	return p.Provider + "@" + p.User
+}
+
+// some providers treat usernames case-insensitively and have rules about what characters can appear. For those
+// we know about, fold and check. For everything else, the username is taken as-is.
+type pidNormalizer func(user string) (string, error)
+
+var pidNormalizers = map[string]pidNormalizer{
+	"twitter.com":    foldAndMatch(regexp.MustCompile(`^[a-z0-9_]{1,15}$`)),
+	"tumblr.com":     foldAndMatch(regexp.MustCompile(`^[a-z0-9-]{1,32}$`)),
+	"reddit.com":     foldAndMatch(regexp.MustCompile(`^[a-z0-9_-]{1,20}$`)),
+	"mastodon.cloud": foldAndMatch(regexp.MustCompile(`^[a-z0-9_]{1,30}$`)),
+}
+
+func foldAndMatch(re *regexp.Regexp) pidNormalizer {
+	return func(user string) (string, error) {
+		user = strings.ToLower(user)
+		if !re.MatchString(user) {
+			return "", errors.New("invalid username '" + user + "'")
+		}
+		return user, nil
+	}
+}
+
+var providerSyntax = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+// ParsePID checks the provider@user syntax and applies per-provider normalization. The provider is a hostname,
+// so it can't contain '@'; the username might, so we split at the first one.
+func ParsePID(s string) (PID, error) {
+	atAt := strings.Index(s, "@")
+	if atAt == -1 {
+		return PID{}, errors.New("PID '" + s + "' is not of the form provider@user")
+	}
+	provider := strings.ToLower(s[:atAt])
+	user := s[atAt+1:]
+	if !providerSyntax.MatchString(provider) {
+		return PID{}, errors.New("PID '" + s + "' has malformed provider")
+	}
+	if user == "" || strings.TrimSpace(user) != user || strings.ContainsAny(user, " \t\r\n") {
+		return PID{}, errors.New("PID '" + s + "' has missing or malformed user")
+	}
+	normalize, ok := pidNormalizers[provider]
+	if ok {
+		var err error
+		user, err = normalize(user)
+		if err != nil {
+			return PID{}, errors.New("PID '" + s + "': " + err.Error())
+		}
+	}
+	return PID{Provider: provider, User: user}, nil
+}
+
+// NormalizePID round-trips a PID string through ParsePID
+func NormalizePID(s string) (string, error) {
+	pid, err := ParsePID(s)
+	if err != nil {
+		return "", err
+	}
+	return pid.String(), nil
+}
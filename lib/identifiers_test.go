@@ -0,0 +1,116 @@
+package blueskidgo
+
+import (
+	"testing"
+)
+
+func TestParseBID(t *testing.T) {
+	good := map[string]uint64{
+		"309F0000021":      0x309F0000021,
+		"309f0000021":      0x309F0000021,
+		"00000309F0000021": 0x309F0000021,
+		"FFFFFFFFFFFFFFFF": 0xFFFFFFFFFFFFFFFF,
+		"0":                0,
+	}
+	for s, wanted := range good {
+		bid, err := ParseBID(s)
+		if err != nil {
+			t.Error("rejected " + s + ": " + err.Error())
+		}
+		if bid != wanted {
+			t.Error("wrong value for " + s)
+		}
+	}
+
+	bad := []string{"", "notHex", "0x309F", "-1", "+1", "10000000000000000", "000000000000000001", " 1", "1_000"}
+	for _, s := range bad {
+		_, err := ParseBID(s)
+		if err == nil {
+			t.Error("accepted BID '" + s + "'")
+		}
+	}
+
+	if FormatBID(0x309F0000021) != "00000309F0000021" {
+		t.Error("FormatBID wrong: " + FormatBID(0x309F0000021))
+	}
+	s, err := NormalizeBID("309f0000021")
+	if err != nil || s != "00000309F0000021" {
+		t.Error("NormalizeBID wrong: " + s)
+	}
+}
+
+func TestParsePID(t *testing.T) {
+	good := map[string]string{
+		"twitter.com@timbray":            "twitter.com@timbray",
+		"twitter.com@TimBray":            "twitter.com@timbray",
+		"Twitter.COM@Tim_Bray":           "twitter.com@tim_bray",
+		"tumblr.com@T-Runic":             "tumblr.com@t-runic",
+		"mastodon.cloud@TimBray":         "mastodon.cloud@timbray",
+		"reddit.com@Tim":                 "reddit.com@tim",
+		"example.org@MixedCase":          "example.org@MixedCase",
+		"example.org@user@elsewhere.com": "example.org@user@elsewhere.com",
+		"Social.Example.ORG@🥁drummer🎸":   "social.example.org@🥁drummer🎸",
+	}
+	for s, wanted := range good {
+		pid, err := ParsePID(s)
+		if err != nil {
+			t.Error("rejected " + s + ": " + err.Error())
+			continue
+		}
+		if pid.String() != wanted {
+			t.Error(s + " normalized to " + pid.String() + ", wanted " + wanted)
+		}
+	}
+
+	bad := []string{
+		"",
+		"timbray",
+		"@timbray",
+		"twitter.com@",
+		"twitter@timbray",
+		"twitter.com@tim bray",
+		"twitter.com@ timbray",
+		"twitter.com@much_too_long_for_twitter",
+		"twitter.com@tim-bray",
+		"tumblr.com@tim_bray",
+		"exa mple.com@tim",
+	}
+	for _, s := range bad {
+		_, err := ParsePID(s)
+		if err == nil {
+			t.Error("accepted PID '" + s + "'")
+		}
+	}
+}
+
+func TestLedgerNormalizesIdentifiers(t *testing.T) {
+	err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "abc0123", PIDs: []string{"Twitter.com@MixedCase"}})
+	if err != nil {
+		t.Error("claim rejected: " + err.Error())
+	}
+	if len(theStore.pidsForBID("000000000ABC0123")) != 1 {
+		t.Error("BID not normalized in PIDsForBID")
+	}
+	if len(theStore.bidsForPID("twitter.com@mixedcase")) != 1 {
+		t.Error("PID not normalized in BIDsForPID")
+	}
+
+	// same BID, different spelling
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "000000000ABC0123", PIDs: []string{"reddit.com@other"}})
+	if err == nil {
+		t.Error("accepted duplicate claim with different BID spelling")
+	}
+
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "not hex", PIDs: []string{"reddit.com@other"}})
+	if err == nil {
+		t.Error("accepted bogus BID")
+	}
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "abc0124", PIDs: []string{"no-provider"}})
+	if err == nil {
+		t.Error("accepted bogus PID")
+	}
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "abc0123", PIDs: []string{"twitter.com@mixedcase"}})
+	if err == nil {
+		t.Error("accepted grant with one PID")
+	}
+}
@@ -1,14 +1,17 @@
 package blueskidgo
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
-	"sync"
+	"time"
 )
 
-// Confession: The ledger is a fake, lives only in memory and is not transactional, not concurrent, and not
-//  persisted. Databases are hard and this is just a demo!
+// Confession: Unless it's given a database (see sqlite.go) or a cluster (see cluster.go), the ledger lives only in
+//  memory and is not persisted. This is just a demo!
 
 type recordType int
 
@@ -16,47 +19,325 @@ const (
 	ClaimBID = iota
 	GrantBID
 	UnclaimBID
+	RevokeKey
+	TransferBID
+	RemovePID
+	PolicyBID
 )
 
+var recTypeNames = map[recordType]string{ClaimBID: "Claim", GrantBID: "Grant", UnclaimBID: "Unclaim", RevokeKey: "Revoke",
+	TransferBID: "Transfer", RemovePID: "Remove", PolicyBID: "Policy"}
+
+// Roles a PID can have in a BID. Owners can grant it to others, remove others, transfer ownership, and revoke
+// keys; members and read-only PIDs can only unclaim themselves. A claimer is an owner, and so is anyone granted
+// the BID by a Grant from before there were roles.
+const (
+	RoleOwner    = "owner"
+	RoleMember   = "member"
+	RoleReadOnly = "read-only"
+)
+
+func validRole(role string) bool {
+	return role == RoleOwner || role == RoleMember || role == RoleReadOnly
+}
+
+// record types are written as their names; numbers, which is how they used to be written, are still read
+func (t recordType) MarshalJSON() ([]byte, error) {
+	name, ok := recTypeNames[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d", int(t))
+	}
+	return json.Marshal(name)
+}
+
+func (t *recordType) UnmarshalJSON(b []byte) error {
+	var name string
+	if json.Unmarshal(b, &name) == nil {
+		return t.setFromName(name)
+	}
+	var number int
+	err := json.Unmarshal(b, &number)
+	if err != nil {
+		return errors.New("record type must be a name or a number")
+	}
+	return t.setFromNumber(number)
+}
+
+func (t *recordType) setFromName(name string) error {
+	found, ok := recTypeFromName(name)
+	if !ok {
+		return errors.New("unknown record type '" + name + "'")
+	}
+	*t = found
+	return nil
+}
+
+func (t *recordType) setFromNumber(number int) error {
+	_, ok := recTypeNames[recordType(number)]
+	if !ok {
+		return fmt.Errorf("unknown record type %d", number)
+	}
+	*t = recordType(number)
+	return nil
+}
+
+const (
+	SubmittedViaAPI       = "api"
+	SubmittedByReverifier = "reverifier"
+)
+
+// Submitter says how a record came to be in the ledger
+type Submitter struct {
+	Via        string    // SubmittedViaAPI or SubmittedByReverifier
+	Submission string    `json:",omitempty"` // the ID of the submission, for records that came in via the API
+	Submitted  time.Time // when the record was asked for; the record's When is when it was accepted
+}
+
 // LedgerRecord
 //  we could have separate types for ClaimBID, GrantBID, and UnclaimBID, but all of these things have a BID,
 //  one or more PIDs, and the URLs of one or more posts.  So, this has less casting.
 // for ClaimBID: PIDs[0] is the claimer, PostURLs[0] is the claim post.
 // for GrantBID: PIDS[0] and [1] are the claimer and accepter, and PostURLs[0] & [1] the grant/accept posts
 // for UnclaimbID: PIDS[0] is the unclaimer, PostURLs[0] is the unclaim post
-// The Key field is provided only for Grant records, to help ensure no re-use of key-pairs.
+// for TransferBID: PIDs[0] is the owner, who becomes a member, and PIDs[1] the new owner; PostURLs and Key are
+//  as for GrantBID
+// for RemovePID: PIDs[0] is the owner doing the removing and PIDs[1] the PID removed, PostURLs[0] is the remove
+//  post, and Key is the key that signed it
+// for PolicyBID: PIDs[0] is the owner setting the policy, PostURLs[0] is the policy post, Key is the key that
+//  signed it, and Threshold is how many owners have to approve changes from then on, see approvals.go
+// for RevokeKey: PIDs[0] is the revoker, PostURLs[0] is the revoke post, and Key is the grant key being revoked.
+//  PIDs[1:] are the PIDs the revocation unmapped from the BID; appendToLedger works those out, see revocation.
+// The Key field is provided for Grant, Transfer, and Remove records, to help ensure no re-use of key-pairs, and
+// for Revoke records. Role is the role a Grant gives the accepter; empty, in Grants from before roles, means owner.
+// Approvals, on records other than Claims and Unclaims, are the other owners who approved, when the BID's policy
+// calls for that.
+// Sequence (the record's position in the ledger), When (the time it was accepted), and Hash are filled in by
+// appendToLedger. Hash chains each record to the one before it; see recordHash.
 type LedgerRecord struct {
-	RecType  recordType
-	BID      string
-	PIDs     []string
-	PostURLs []string
-	Key      string
+	Sequence  int
+	RecType   recordType
+	BID       string
+	PIDs      []string
+	PostURLs  []string
+	Key       string
+	Role      string     `json:",omitempty"`
+	Threshold int        `json:",omitempty"`
+	Approvals []Approval `json:",omitempty"`
+	When      time.Time
+	Hash      string
+	Submitter *Submitter `json:",omitempty"`
+}
+
+// hashedRecord is what goes into a record's hash. It doesn't change when the way records are shown changes, so that
+// old hashes stay good: RecType stays a number, and fields added since hashes were introduced are omitted when
+// they're empty.
+type hashedRecord struct {
+	Sequence  int
+	RecType   int
+	BID       string
+	PIDs      []string
+	PostURLs  []string
+	Key       string
+	When      time.Time
+	Hash      string
+	Submitter *Submitter `json:",omitempty"`
+	Role      string     `json:",omitempty"`
+	Threshold int        `json:",omitempty"`
+	Approvals []Approval `json:",omitempty"`
+}
+
+// recordHash is the hex SHA-256 of the record's hashedRecord JSON with the previous record's hash (empty for the
+// first record) in place of its own, so agreeing on the latest hash means agreeing on the whole ledger.
+func recordHash(previous string, record *LedgerRecord) string {
+	b, _ := json.Marshal(&hashedRecord{
+		Sequence:  record.Sequence,
+		RecType:   int(record.RecType),
+		BID:       record.BID,
+		PIDs:      record.PIDs,
+		PostURLs:  record.PostURLs,
+		Key:       record.Key,
+		When:      record.When,
+		Hash:      previous,
+		Submitter: record.Submitter,
+		Role:      record.Role,
+		Threshold: record.Threshold,
+		Approvals: record.Approvals,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
 }
 
 // we'll build a dumb little database to maintain BID/PID mappings
 
-// PIDsForBID is indexed by BID; values are set-like maps containing the PIDs mapped to that BID
-var PIDsForBID = make(map[string]map[string]bool)
+// bidMappings holds the mappings in both directions. The same code maintains the live ones in theStore and the
+// historical ones rebuilt by replaying the ledger.
+//  PIDsForBID is indexed by BID; values are set-like maps containing the PIDs mapped to that BID
+//  BIDsForPID is indexed by PID; values are set-like maps containing the BIDs mapped to that PID
+//  Roles is indexed by BID; values map each PID mapped to that BID to its role
+//  RevokedKeys is indexed by BID; values are set-like maps containing the revoked keys that granted that BID
+//  Thresholds is indexed by BID; values are how many owners have to approve changes to it, if that's more than one
+//  Tombstones is indexed by BID; values are when the last PID left that BID, for claimed BIDs that have no PIDs
+//  ComponentOf is indexed by PID; values label the connected component of the PID/BID graph it's in, see pid_graph.go
+//  Components is indexed by component label; values are set-like maps containing the PIDs in that component
+type bidMappings struct {
+	PIDsForBID  map[string]map[string]bool
+	BIDsForPID  map[string]map[string]bool
+	Roles       map[string]map[string]string
+	RevokedKeys map[string]map[string]bool
+	Thresholds  map[string]int
+	Tombstones  map[string]time.Time
+	ComponentOf map[string]string
+	Components  map[string]map[string]bool
+}
 
-// BIDsForPID is indexed by PID; values are set-like maps containing the BIDs mapped to that BID
-var BIDsForPID = make(map[string]map[string]bool)
+func newBIDMappings() *bidMappings {
+	return &bidMappings{PIDsForBID: make(map[string]map[string]bool), BIDsForPID: make(map[string]map[string]bool),
+		Roles: make(map[string]map[string]string), RevokedKeys: make(map[string]map[string]bool),
+		Thresholds: make(map[string]int), Tombstones: make(map[string]time.Time),
+		ComponentOf: make(map[string]string), Components: make(map[string]map[string]bool)}
+}
 
-// KeysUsed tracks the public keys that have appeared in assertions, so as to prevent re-use.
-var KeysUsed = make(map[string]bool)
+// grantedRole is the role a Grant gives
+func grantedRole(record *LedgerRecord) string {
+	if record.Role == "" {
+		return RoleOwner
+	}
+	return record.Role
+}
+
+// apply updates the mappings to reflect a record, which is assumed to have been checked by appendToLedger
+func (m *bidMappings) apply(record *LedgerRecord) {
+	switch record.RecType {
+	case ClaimBID:
+		// a tombstoned BID that's claimed again starts afresh
+		delete(m.Tombstones, record.BID)
+		delete(m.Thresholds, record.BID)
+		m.add(record.BID, record.PIDs[0], RoleOwner)
+	case GrantBID:
+		m.add(record.BID, record.PIDs[1], grantedRole(record))
+	case TransferBID:
+		m.add(record.BID, record.PIDs[0], RoleMember)
+		m.add(record.BID, record.PIDs[1], RoleOwner)
+	case UnclaimBID:
+		// the BID's PID set may now be empty, in which case it's tombstoned below; whether it can be claimed
+		//  again is up to BIDReuse
+		m.remove(record.BID, record.PIDs[0])
+	case RemovePID:
+		m.remove(record.BID, record.PIDs[1])
+	case PolicyBID:
+		if record.Threshold > 1 {
+			m.Thresholds[record.BID] = record.Threshold
+		} else {
+			delete(m.Thresholds, record.BID)
+		}
+	case RevokeKey:
+		for _, pid := range record.PIDs[1:] {
+			m.remove(record.BID, pid)
+		}
+		keys, ok := m.RevokedKeys[record.BID]
+		if !ok {
+			keys = make(map[string]bool)
+			m.RevokedKeys[record.BID] = keys
+		}
+		keys[record.Key] = true
+	}
+	if pids, ok := m.PIDsForBID[record.BID]; ok && len(pids) == 0 {
+		if _, already := m.Tombstones[record.BID]; !already {
+			m.Tombstones[record.BID] = record.When
+		}
+	}
+}
+
+func (m *bidMappings) remove(bid string, pid string) {
+	delete(m.PIDsForBID[bid], pid)
+	delete(m.BIDsForPID[pid], bid)
+	delete(m.Roles[bid], pid)
+	m.split(pid)
+}
+
+// add maps pid to bid with role, or if it's mapped already, changes its role
+func (m *bidMappings) add(bid string, pid string, role string) {
+	pids, ok := m.PIDsForBID[bid]
+	if !ok {
+		pids = make(map[string]bool)
+		m.PIDsForBID[bid] = pids
+	}
+	pids[pid] = true
+
+	roles, ok := m.Roles[bid]
+	if !ok {
+		roles = make(map[string]string)
+		m.Roles[bid] = roles
+	}
+	roles[pid] = role
+
+	bids, ok := m.BIDsForPID[pid]
+	if !ok {
+		bids = make(map[string]bool)
+		m.BIDsForPID[pid] = bids
+	}
+	bids[bid] = true
+	m.join(bid, pid)
+}
+
+func (m *bidMappings) clone() *bidMappings {
+	c := newBIDMappings()
+	for bid, pids := range m.PIDsForBID {
+		c.PIDsForBID[bid] = make(map[string]bool)
+		for pid := range pids {
+			c.PIDsForBID[bid][pid] = true
+		}
+	}
+	for pid, bids := range m.BIDsForPID {
+		c.BIDsForPID[pid] = make(map[string]bool)
+		for bid := range bids {
+			c.BIDsForPID[pid][bid] = true
+		}
+	}
+	for bid, threshold := range m.Thresholds {
+		c.Thresholds[bid] = threshold
+	}
+	for bid, when := range m.Tombstones {
+		c.Tombstones[bid] = when
+	}
+	for bid, roles := range m.Roles {
+		c.Roles[bid] = make(map[string]string)
+		for pid, role := range roles {
+			c.Roles[bid][pid] = role
+		}
+	}
+	for bid, keys := range m.RevokedKeys {
+		c.RevokedKeys[bid] = make(map[string]bool)
+		for key := range keys {
+			c.RevokedKeys[bid][key] = true
+		}
+	}
+	for pid, label := range m.ComponentOf {
+		c.ComponentOf[pid] = label
+	}
+	for label, pids := range m.Components {
+		c.Components[label] = make(map[string]bool)
+		for pid := range pids {
+			c.Components[label][pid] = true
+		}
+	}
+	return c
+}
 
 /*
 // for debugging
 func dumpDB(label string) {
+	m := theStore.mappings
 	fmt.Println(label)
 	fmt.Println("P4B")
-	for k, v := range PIDsForBID {
+	for k, v := range m.PIDsForBID {
 		fmt.Println(k + ": ")
 		for kk := range v {
 			fmt.Println("  " + kk)
 		}
 	}
 	fmt.Println("\nB4P")
-	for k, v := range BIDsForPID {
+	for k, v := range m.BIDsForPID {
 		fmt.Println(k + ": ")
 		for kk := range v {
 			fmt.Println("  " + kk)
@@ -70,110 +351,487 @@ type LedgerScanner interface {
 }
 
 func Scan(scanner LedgerScanner) error {
-	var err error
-	for _, record := range theLedger.Records {
-		err = scanner.processRecord(record)
-		if err != nil {
-			return err
-		}
+	_, err := ScanRange(scanner, nil, -1, 0)
+	return err
+}
+
+// appendToLedger also performs sanity-checking to make sure the claim/unclaim/grant being requested is legitimate.
+// It either appends the record and updates everything derived from the ledger, or returns an error and changes nothing.
+func appendToLedger(record *LedgerRecord) error {
+	return theStore.append(record)
+}
+
+func (s *ledgerStore) append(record *LedgerRecord) error {
+	if s.cluster != nil {
+		return s.cluster.append(record)
 	}
-	return nil
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	txn, err := s.begin(record, time.Now())
+	if err != nil {
+		return err
+	}
+	return txn.run()
 }
 
-type ledger struct {
-	Records []*LedgerRecord
+// replicate appends a record that has already been appended to the primary's ledger. It has to be the next one,
+// chain on to what's here, and pass the same checks it passed on the primary.
+func (s *ledgerStore) replicate(record *LedgerRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record.Sequence != len(s.records) {
+		return fmt.Errorf("expected record %d, got %d", len(s.records), record.Sequence)
+	}
+	txn, err := s.begin(record, record.When)
+	if err != nil {
+		return err
+	}
+	if txn.next.Hash != record.Hash {
+		return fmt.Errorf("record %d has hash %s, should be %s", record.Sequence, record.Hash, txn.next.Hash)
+	}
+	txn.replicated = true
+	return txn.run()
 }
 
-var theLedger  = ledger{Records: make([]*LedgerRecord,0)}
-var theLock sync.Mutex
+// ledgerIndexes are the questions that validating a record asks. The store answers them from memory; the SQLite
+// store answers them from the tables, inside the transaction that will write the record.
+type ledgerIndexes interface {
+	bidExists(bid string) (bool, error)
+	isMappedTo(bid string, pid string) (bool, error)
+	roleOf(bid string, pid string) (string, error) // "" if pid isn't mapped to bid
+	owners(bid string) (int, error)
+	threshold(bid string) (int, error) // 0 if the BID has no policy
+	tombstoned(bid string) (since time.Time, ok bool, err error)
+	keyUsed(key string) (bool, error)
+	keyRevoked(key string) (bool, error)
+}
 
-// appendToLedger also performs sanity-checking to make sure the claim/unclaim/grant being requested is legitimate
-func appendToLedger(record *LedgerRecord) error {
+// these must be called with the store locked
 
-	// mad skillz at distributed concurrency
-	theLock.Lock()
-	defer theLock.Unlock()
+// bidExists is true for any BID that has ever been claimed, even if everyone has since unclaimed it
+func (s *ledgerStore) bidExists(bid string) (bool, error) {
+	_, ok := s.mappings.PIDsForBID[bid]
+	return ok, nil
+}
 
-	switch record.RecType {
-	case ClaimBID:
-		claimingPID := record.PIDs[0]
+func (s *ledgerStore) isMappedTo(bid string, pid string) (bool, error) {
+	return s.mappings.PIDsForBID[bid][pid], nil
+}
 
-		// is this BID available?
-		_, ok := PIDsForBID[record.BID]
-		if ok {
-			return errors.New("BID '" + record.BID + "' has already been claimed by another account")
+func (s *ledgerStore) roleOf(bid string, pid string) (string, error) {
+	return s.mappings.Roles[bid][pid], nil
+}
+
+func (s *ledgerStore) owners(bid string) (int, error) {
+	count := 0
+	for _, role := range s.mappings.Roles[bid] {
+		if role == RoleOwner {
+			count++
 		}
+	}
+	return count, nil
+}
 
-		// map from BID to PID
-		PIDsForBID[record.BID] = map[string]bool{claimingPID: true}
+func (s *ledgerStore) threshold(bid string) (int, error) {
+	return s.mappings.Thresholds[bid], nil
+}
 
-		// map from PID to BID
-		bidsForClaimingPID, ok := BIDsForPID[claimingPID]
-		if !ok {
-			bidsForClaimingPID = make(map[string]bool)
-			BIDsForPID[claimingPID] = bidsForClaimingPID
+func (s *ledgerStore) tombstoned(bid string) (time.Time, bool, error) {
+	since, ok := s.mappings.Tombstones[bid]
+	return since, ok, nil
+}
+
+func (s *ledgerStore) keyUsed(key string) (bool, error) {
+	return s.keysUsed[key], nil
+}
+
+func (s *ledgerStore) keyRevoked(key string) (bool, error) {
+	for _, keys := range s.mappings.RevokedKeys {
+		if keys[key] {
+			return true, nil
 		}
-		bidsForClaimingPID[record.BID] = true
+	}
+	return false, nil
+}
 
-	case GrantBID:
-		granter := record.PIDs[0]
-		accepter := record.PIDs[1]
-		pidsForGrantedBID, ok := PIDsForBID[record.BID]
+// ledgerTxn is one append in progress. validate only reads; everything that changes the store, including the
+// caller's record, happens in commit, so a record that's rejected leaves no trace.
+type ledgerTxn struct {
+	store  *ledgerStore
+	record *LedgerRecord // what the caller passed in
+	next   LedgerRecord  // what will be appended
+	now    time.Time
 
-		// granter has to own PID
-		if !ok {
-			return errors.New("no such BID: " + record.BID)
+	// replicated is set when the record has already been accepted elsewhere, so reservations, which are only
+	// known to the server that made them, have been checked already, and webhooks have been told about it
+	replicated bool
+
+	// for a Revoke, the Grant that used the key, if there is one
+	revokedGrant *LedgerRecord
+}
+
+// begin must be called with the store locked
+func (s *ledgerStore) begin(record *LedgerRecord, now time.Time) (*ledgerTxn, error) {
+	txn := &ledgerTxn{store: s, record: record, next: *record, now: now}
+	txn.next.PIDs = append([]string(nil), record.PIDs...)
+	txn.next.PostURLs = append([]string(nil), record.PostURLs...)
+	txn.next.Approvals = append([]Approval(nil), record.Approvals...)
+	if record.Submitter != nil {
+		submitter := *record.Submitter
+		submitter.Submitted = submitter.Submitted.UTC()
+		txn.next.Submitter = &submitter
+	}
+	err := normalizeRecord(&txn.next)
+	if err != nil {
+		return nil, err
+	}
+	if txn.next.RecType == RevokeKey {
+		// whatever the caller said, the PIDs to unmap are worked out from the ledger
+		var unmapped []string
+		txn.revokedGrant, unmapped = s.revocation(txn.next.BID, txn.next.Key)
+		txn.next.PIDs = append(txn.next.PIDs[:1], unmapped...)
+	}
+	txn.next.Sequence = len(s.records)
+	txn.next.When = now.UTC()
+	previous := ""
+	if len(s.records) > 0 {
+		previous = s.records[len(s.records)-1].Hash
+	}
+	txn.next.Hash = recordHash(previous, &txn.next)
+	return txn, nil
+}
+
+// run validates and, if that works, commits
+func (txn *ledgerTxn) run() error {
+	s := txn.store
+	var err error
+	if s.db != nil {
+		// the database has the last word, and gets its copy of the record first
+		err = s.db.append(txn)
+	} else {
+		err = txn.validate(s)
+	}
+	if err != nil {
+		return err
+	}
+	txn.commit()
+	return nil
+}
+
+// validate checks that the claim/unclaim/grant is legitimate given what's already in the ledger
+func (txn *ledgerTxn) validate(indexes ledgerIndexes) error {
+	record := &txn.next
+
+	switch record.RecType {
+	case ClaimBID:
+		// is this BID available?
+		exists, err := indexes.bidExists(record.BID)
+		if err != nil {
+			return err
 		}
-		_, ok = pidsForGrantedBID[granter]
-		if !ok {
-			return errors.New("this account is not mapped to BID " + record.BID)
+		if exists {
+			_, tombstoned, err := indexes.tombstoned(record.BID)
+			if err != nil {
+				return err
+			}
+			if !tombstoned {
+				return errors.New("BID '" + record.BID + "' has already been claimed by another account")
+			}
+		}
+		// like reservations, reuse is for the server that took the record to decide; in a cluster, that's the
+		// leader, in Cluster.append
+		if txn.replicated {
+			return nil
+		}
+		err = checkReuse(indexes, record.BID, txn.now)
+		if err != nil {
+			return err
+		}
+		return txn.store.checkReservation(record.BID, record.PIDs[0], txn.now)
+
+	case GrantBID, TransferBID, RemovePID, PolicyBID:
+		// granter, transferor, remover, or policy-setter has to own the BID
+		err := txn.checkOwner(indexes)
+		if err != nil {
+			return err
+		}
+		if record.RecType == GrantBID && !validRole(grantedRole(record)) {
+			return errors.New("unknown role '" + record.Role + "'")
+		}
+		if record.RecType == TransferBID && record.PIDs[0] == record.PIDs[1] {
+			return errors.New("can't transfer a BID to its owner")
+		}
+		if record.RecType == RemovePID {
+			if record.PIDs[0] == record.PIDs[1] {
+				return errors.New("to remove yourself from a BID, unclaim it")
+			}
+			mapped, err := indexes.isMappedTo(record.BID, record.PIDs[1])
+			if err != nil {
+				return err
+			}
+			if !mapped {
+				return errors.New(record.PIDs[1] + " is not mapped to BID " + record.BID)
+			}
+		}
+		if record.RecType == TransferBID || record.RecType == RemovePID {
+			err = txn.checkOwnersLeft(indexes)
+			if err != nil {
+				return err
+			}
+		}
+		if record.RecType == PolicyBID {
+			if record.Threshold < 1 {
+				return errors.New("a policy's threshold must be at least 1")
+			}
+			owners, err := indexes.owners(record.BID)
+			if err != nil {
+				return err
+			}
+			if record.Threshold > owners {
+				return fmt.Errorf("BID %s has only %d owners, too few to meet a threshold of %d", record.BID, owners, record.Threshold)
+			}
 		}
 
 		// has key been used?
-		_, ok = KeysUsed[record.Key]
-		if ok {
+		used, err := indexes.keyUsed(record.Key)
+		if err != nil {
+			return err
+		}
+		if used {
 			return errors.New("public key has been used in a previous grant transaction")
 		}
-		KeysUsed[record.Key] = true
-
-		// map from BID to accepter PID
-		pidsForGrantedBID[accepter] = true
-
-		// map from accepter PID to BID
-		bidsForAccepter, ok := BIDsForPID[accepter]
-		if !ok {
-			bidsForAccepter = make(map[string]bool)
-			BIDsForPID[accepter] = bidsForAccepter
+		switch record.RecType {
+		case GrantBID, PolicyBID, TransferBID:
+			return txn.checkApprovals(indexes)
+		case RemovePID:
+			// removing an owner changes who runs the BID as much as a Transfer does
+			return txn.checkApprovalsIfOwner(indexes, record.PIDs[1:])
 		}
-		bidsForAccepter[record.BID] = true
 
 	case UnclaimBID:
 		// can only do this if this BID exists and I'm mapped to it
-		currentPIDs, ok := PIDsForBID[record.BID]
-		if !ok {
-			return errors.New("no such BID: " + record.BID)
+		err := txn.checkMapped(indexes)
+		if err != nil {
+			return err
 		}
-		_, ok = currentPIDs[record.PIDs[0]]
-		if !ok {
-			return errors.New("this account is not mapped to BID " + record.BID)
+		return txn.checkOwnersLeft(indexes)
+
+	case RevokeKey:
+		// revoker has to own PID, and not because of the key being revoked
+		err := txn.checkOwner(indexes)
+		if err != nil {
+			return err
+		}
+		if txn.revokedGrant == nil {
+			return errors.New("public key was not used to grant BID " + record.BID)
+		}
+		revoked, err := indexes.keyRevoked(record.Key)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return errors.New("public key has already been revoked")
 		}
+		if containsString(record.PIDs[1:], record.PIDs[0]) {
+			return errors.New("this account's mapping depends on the key being revoked")
+		}
+		err = txn.checkOwnersLeft(indexes)
+		if err != nil {
+			return err
+		}
+		return txn.checkApprovalsIfOwner(indexes, record.PIDs[1:])
 
-		// remove the mapping between PID to BID
-		// note - the pidsForGrantedBID map may now be empty but we won't free up the BID, because they probably
-		//  shouldn't be re-used.
-		delete(currentPIDs, record.PIDs[0])
+	default:
+		return errors.New("unknown record type")
+	}
+	return nil
+}
 
-		currentBIDs, _ := BIDsForPID[record.PIDs[0]]
-		delete(currentBIDs, record.BID)
+func (txn *ledgerTxn) checkMapped(indexes ledgerIndexes) error {
+	record := &txn.next
+	exists, err := indexes.bidExists(record.BID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("no such BID: " + record.BID)
+	}
+	mapped, err := indexes.isMappedTo(record.BID, record.PIDs[0])
+	if err != nil {
+		return err
 	}
+	if !mapped {
+		return errors.New("this account is not mapped to BID " + record.BID)
+	}
+	return nil
+}
 
-	theLedger.Records = append(theLedger.Records, record)
+// checkApprovals checks that enough owners, counting the one who asked, approved the record. If they didn't, the
+// error is an ApprovalsNeededError.
+func (txn *ledgerTxn) checkApprovals(indexes ledgerIndexes) error {
+	record := &txn.next
+	approvers := map[string]bool{record.PIDs[0]: true}
+	for _, approval := range record.Approvals {
+		role, err := indexes.roleOf(record.BID, approval.PID)
+		if err != nil {
+			return err
+		}
+		if role != RoleOwner {
+			return errors.New(approval.PID + " approved, but isn't an owner of BID " + record.BID)
+		}
+		approvers[approval.PID] = true
+	}
+	threshold, err := indexes.threshold(record.BID)
+	if err != nil {
+		return err
+	}
+	if len(approvers) < threshold {
+		return &ApprovalsNeededError{BID: record.BID, Have: len(approvers), Need: threshold}
+	}
 	return nil
 }
 
-func LedgerHandler(w http.ResponseWriter, _ *http.Request) {
-	bytes, err := json.MarshalIndent(theLedger, "", " ")
-	writeJson(w, bytes, err)
+// checkApprovalsIfOwner is checkApprovals, if any of pids is an owner
+func (txn *ledgerTxn) checkApprovalsIfOwner(indexes ledgerIndexes, pids []string) error {
+	for _, pid := range pids {
+		role, err := indexes.roleOf(txn.next.BID, pid)
+		if err != nil {
+			return err
+		}
+		if role == RoleOwner {
+			return txn.checkApprovals(indexes)
+		}
+	}
+	return nil
+}
+
+// checkOwnersLeft refuses an Unclaim, Transfer, Remove, or Revoke that would leave the BID with fewer owners than
+// its threshold, since then nothing that needs approvals could ever be done to it again
+func (txn *ledgerTxn) checkOwnersLeft(indexes ledgerIndexes) error {
+	record := &txn.next
+	threshold, err := indexes.threshold(record.BID)
+	if err != nil || threshold <= 1 {
+		return err
+	}
+	owners, err := indexes.owners(record.BID)
+	if err != nil {
+		return err
+	}
+	leaving := record.PIDs[:1]
+	if record.RecType == RemovePID || record.RecType == RevokeKey {
+		leaving = record.PIDs[1:]
+	}
+	for _, pid := range leaving {
+		role, err := indexes.roleOf(record.BID, pid)
+		if err != nil {
+			return err
+		}
+		if role == RoleOwner {
+			owners--
+		}
+	}
+	if record.RecType == TransferBID {
+		role, err := indexes.roleOf(record.BID, record.PIDs[1])
+		if err != nil {
+			return err
+		}
+		if role != RoleOwner {
+			owners++
+		}
+	}
+	if owners < threshold {
+		return fmt.Errorf("that would leave BID %s with %d owners, too few to meet its threshold of %d", record.BID, owners, threshold)
+	}
+	return nil
+}
+
+// checkOwner is checkMapped, but the PID has to be an owner
+func (txn *ledgerTxn) checkOwner(indexes ledgerIndexes) error {
+	err := txn.checkMapped(indexes)
+	if err != nil {
+		return err
+	}
+	role, err := indexes.roleOf(txn.next.BID, txn.next.PIDs[0])
+	if err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		return errors.New("this account's role in BID " + txn.next.BID + " is " + role + "; only owners can do that")
+	}
+	return nil
+}
+
+// commit applies a validated record to every in-memory index; nothing in here can fail
+func (txn *ledgerTxn) commit() {
+	s := txn.store
+	// the caller gets a copy of what was appended, and can't change the ledger by changing it
+	*txn.record = txn.next
+	txn.record.PIDs = append([]string(nil), txn.next.PIDs...)
+	txn.record.PostURLs = append([]string(nil), txn.next.PostURLs...)
+	txn.record.Approvals = append([]Approval(nil), txn.next.Approvals...)
+	record := &txn.next
+
+	if record.RecType == ClaimBID {
+		delete(s.reservations, record.BID)
+	}
+	if usesKey(record) {
+		s.keysUsed[record.Key] = true
+	}
+	s.mappings.apply(record)
+	s.records = append(s.records, record)
+
+	close(s.appendSignal)
+	s.appendSignal = make(chan struct{})
+	if s.announce && !txn.replicated {
+		announceAppend(record)
+	}
+}
+
+// usesKey is true for records whose Key can only ever be used once
+func usesKey(record *LedgerRecord) bool {
+	return record.RecType == GrantBID || record.RecType == TransferBID || record.RecType == RemovePID ||
+		record.RecType == PolicyBID
+}
+
+// normalizeRecord puts the BID and PIDs into canonical form so that the same identity is always the same map key
+func normalizeRecord(record *LedgerRecord) error {
+	wantedPIDs := 1
+	if record.RecType == GrantBID || record.RecType == TransferBID || record.RecType == RemovePID {
+		wantedPIDs = 2
+	}
+	if record.Role != "" && record.RecType != GrantBID {
+		return errors.New("only Grant records have a role")
+	}
+	if record.Threshold != 0 && record.RecType != PolicyBID {
+		return errors.New("only Policy records have a threshold")
+	}
+	if len(record.Approvals) > 0 && (record.RecType == ClaimBID || record.RecType == UnclaimBID) {
+		return errors.New("Claim and Unclaim records don't have approvals")
+	}
+	if len(record.PIDs) != wantedPIDs && !(record.RecType == RevokeKey && len(record.PIDs) > 1) {
+		return errors.New("wrong number of PIDs in ledger record")
+	}
+
+	bid, err := NormalizeBID(record.BID)
+	if err != nil {
+		return err
+	}
+	record.BID = bid
+	for i, pid := range record.PIDs {
+		record.PIDs[i], err = NormalizePID(pid)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range record.Approvals {
+		record.Approvals[i].PID, err = NormalizePID(record.Approvals[i].PID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type getPIDGroupHandlerResult struct {
@@ -181,10 +839,16 @@ type getPIDGroupHandlerResult struct {
 }
 
 func makePIDgroup(pid string) map[string]bool {
+	var group map[string]bool
+	theStore.readMappings(func(m *bidMappings) { group = m.pidGroup(pid) })
+	return group
+}
+
+func (m *bidMappings) pidGroup(pid string) map[string]bool {
 	var group = map[string]bool{pid: true}
 	// a PID=>PID map could be precomputed of course
-	for bid := range BIDsForPID[pid] {
-		for otherPid := range PIDsForBID[bid] {
+	for bid := range m.BIDsForPID[pid] {
+		for otherPid := range m.PIDsForBID[bid] {
 			group[otherPid] = true
 		}
 	}
@@ -201,8 +865,20 @@ func GetPIDGroupHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		http.Error(w, "missing parameter 'pid'", http.StatusBadRequest)
 		return
 	}
+	pid, err := NormalizePID(pid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'pid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	group := makePIDgroup(pid)
+	var group map[string]bool
+	err = storeFor(httpRequest).withMappingsAsOf(httpRequest.Form.Get("asOf"), func(m *bidMappings) {
+		group = m.pidGroup(pid)
+	})
+	if err != nil {
+		http.Error(w, "invalid parameter 'asOf': "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	var resp getPIDGroupHandlerResult
 	for member := range group {
 		resp.PIDGroup = append(resp.PIDGroup, member)
@@ -231,12 +907,18 @@ func GetBIDsforPIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		http.Error(w, "missing parameter 'pid'", http.StatusBadRequest)
 		return
 	}
+	pid, err := NormalizePID(pid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'pid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	var resp getBIDsforPIDResponse
-	pidSet, ok := BIDsForPID[pid]
-	if ok {
-		for bid := range pidSet {
-			resp.BIDs = append(resp.BIDs, bid)
-		}
+	err = storeFor(httpRequest).withMappingsAsOf(httpRequest.Form.Get("asOf"), func(m *bidMappings) {
+		resp.BIDs = sortedKeys(m.BIDsForPID[pid])
+	})
+	if err != nil {
+		http.Error(w, "invalid parameter 'asOf': "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	respJSON, err := json.MarshalIndent(resp, "", " ")
@@ -245,7 +927,10 @@ func GetBIDsforPIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 }
 
 type getPIDsForBIDResponse struct {
-	PIDs []string
+	PIDs        []string
+	Roles       map[string]string // each PID's role
+	Threshold   int               `json:",omitempty"` // how many owners have to approve a change
+	RevokedKeys []string          `json:",omitempty"`
 }
 
 func GetPIDsForBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
@@ -258,12 +943,24 @@ func GetPIDsForBIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		http.Error(w, "missing parameter 'bid'", http.StatusBadRequest)
 		return
 	}
+	bid, err := NormalizeBID(bid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'bid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	var resp getPIDsForBIDResponse
-	bidSet, ok := PIDsForBID[bid]
-	if ok {
-		for pid := range bidSet {
-			resp.PIDs = append(resp.PIDs, pid)
+	err = storeFor(httpRequest).withMappingsAsOf(httpRequest.Form.Get("asOf"), func(m *bidMappings) {
+		resp.PIDs = sortedKeys(m.PIDsForBID[bid])
+		resp.Roles = make(map[string]string)
+		for pid, role := range m.Roles[bid] {
+			resp.Roles[pid] = role
 		}
+		resp.Threshold = m.Thresholds[bid]
+		resp.RevokedKeys = sortedKeys(m.RevokedKeys[bid])
+	})
+	if err != nil {
+		http.Error(w, "invalid parameter 'asOf': "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	respJSON, err := json.MarshalIndent(resp, "", " ")
@@ -0,0 +1,213 @@
+package blueskidgo
+
+// selecting slices of the ledger, so nobody has to swallow the whole thing at once
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPageSize and MaxPageSize govern the 'limit' parameter of /ledger
+var DefaultPageSize = 1000
+var MaxPageSize = 10000
+
+// LedgerFilter selects ledger records. Zero-valued fields match everything.
+type LedgerFilter struct {
+	RecTypes []recordType
+	BID      string
+	PID      string
+	PostURL  string
+	Since    time.Time
+	Until    time.Time
+}
+
+func (f *LedgerFilter) matches(record *LedgerRecord) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.RecTypes) > 0 {
+		found := false
+		for _, t := range f.RecTypes {
+			if t == record.RecType {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.BID != "" && f.BID != record.BID {
+		return false
+	}
+	if f.PID != "" && !containsString(record.PIDs, f.PID) {
+		return false
+	}
+	if f.PostURL != "" && !containsString(record.PostURLs, f.PostURL) {
+		return false
+	}
+	if !f.Since.IsZero() && record.When.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.When.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, member := range list {
+		if member == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanRange is Scan, but only for records whose Sequence is greater than after and which match filter, and it
+// stops after limit of them (0 means no limit). more is true if there are matching records beyond those scanned.
+func ScanRange(scanner LedgerScanner, filter *LedgerFilter, after int, limit int) (more bool, err error) {
+	return theStore.scanRange(scanner, filter, after, limit)
+}
+
+func (s *ledgerStore) scanRange(scanner LedgerScanner, filter *LedgerFilter, after int, limit int) (more bool, err error) {
+	records := s.recordsSoFar()
+
+	start := after + 1
+	if start < 0 {
+		start = 0
+	}
+	matched := 0
+	for i := start; i < len(records); i++ {
+		if !filter.matches(records[i]) {
+			continue
+		}
+		if limit > 0 && matched == limit {
+			return true, nil
+		}
+		err = scanner.processRecord(records[i])
+		if err != nil {
+			return
+		}
+		matched++
+	}
+	return
+}
+
+// recordCollector is the simplest possible LedgerScanner
+type recordCollector struct {
+	records []*LedgerRecord
+}
+
+func (c *recordCollector) processRecord(record *LedgerRecord) error {
+	c.records = append(c.records, record)
+	return nil
+}
+
+// parseLedgerFilter reads the filter parameters shared by the endpoints that select ledger records
+func parseLedgerFilter(form url.Values) (*LedgerFilter, error) {
+	var filter LedgerFilter
+	var err error
+
+	if types := form.Get("type"); types != "" {
+		for _, name := range strings.Split(types, ",") {
+			t, ok := recTypeFromName(name)
+			if !ok {
+				return nil, errors.New("unknown record type '" + name + "'")
+			}
+			filter.RecTypes = append(filter.RecTypes, t)
+		}
+	}
+	if bid := form.Get("bid"); bid != "" {
+		filter.BID, err = NormalizeBID(bid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pid := form.Get("pid"); pid != "" {
+		filter.PID, err = NormalizePID(pid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	filter.PostURL = form.Get("post")
+	if since := form.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, errors.New("'since' must be an RFC3339 timestamp")
+		}
+	}
+	if until := form.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, errors.New("'until' must be an RFC3339 timestamp")
+		}
+	}
+	return &filter, nil
+}
+
+func recTypeFromName(name string) (recordType, bool) {
+	for t, n := range recTypeNames {
+		if strings.EqualFold(n, name) {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+type ledgerPage struct {
+	Records     []*LedgerRecord
+	NextCursor  string   `json:",omitempty"`
+	RevokedKeys []string `json:",omitempty"` // the keys of any Grants in Records that have been revoked
+}
+
+// LedgerHandler serves /ledger. With no parameters you get the first page of the whole ledger; NextCursor, if
+// present, is the value to use as 'after' to get the next page.
+func LedgerHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	filter, err := parseLedgerFilter(httpRequest.Form)
+	if err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	after := -1
+	if s := httpRequest.Form.Get("after"); s != "" {
+		after, err = strconv.Atoi(s)
+		if err != nil || after < -1 {
+			http.Error(w, "parameter 'after' must be a ledger sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := DefaultPageSize
+	if s := httpRequest.Form.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			http.Error(w, "parameter 'limit' must be between 1 and "+strconv.Itoa(MaxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s := storeFor(httpRequest)
+	var collector recordCollector
+	more, err := s.scanRange(&collector, filter, after, limit)
+	if err != nil {
+		http.Error(w, "ledger scan failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := ledgerPage{Records: collector.records}
+	if page.Records == nil {
+		page.Records = []*LedgerRecord{}
+	}
+	if more {
+		page.NextCursor = strconv.Itoa(page.Records[len(page.Records)-1].Sequence)
+	}
+	page.RevokedKeys = s.revokedKeysAmong(page.Records)
+	bytes, err := json.MarshalIndent(page, "", " ")
+	writeJson(w, bytes, err)
+}
@@ -0,0 +1,102 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getLedgerPage(t *testing.T, query string) ledgerPage {
+	w := httptest.NewRecorder()
+	LedgerHandler(w, httptest.NewRequest("GET", "/ledger"+query, nil))
+	var page ledgerPage
+	if w.Code != 200 {
+		t.Error("GET /ledger" + query + ": " + w.Body.String())
+		return page
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &page)
+	if err != nil {
+		t.Error("bad JSON: " + err.Error())
+	}
+	return page
+}
+
+func TestLedgerQueries(t *testing.T) {
+	defer freshLedger()()
+
+	// 0-4 claims, 5 grant, 6 unclaim
+	for i := 0; i < 5; i++ {
+		_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: FormatBID(uint64(0x9a0 + i)), PIDs: []string{"twitter.com@q" + string(rune('0'+i))}, PostURLs: []string{"https://example.com/q" + string(rune('0'+i))}})
+	}
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "9a0", PIDs: []string{"twitter.com@q0", "reddit.com@q9"}, PostURLs: []string{"g", "a"}, Key: newPubKey()})
+	midpoint := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "9a1", PIDs: []string{"twitter.com@q1"}, PostURLs: []string{"https://example.com/u1"}})
+
+	page := getLedgerPage(t, "")
+	if len(page.Records) != 7 || page.NextCursor != "" {
+		t.Error("default query wrong")
+	}
+	for i, record := range page.Records {
+		if record.Sequence != i {
+			t.Error("wrong sequence")
+		}
+	}
+
+	// pagination
+	var seen []int
+	cursor := "-1"
+	for pages := 0; pages < 10 && cursor != ""; pages++ {
+		page = getLedgerPage(t, "?limit=3&after="+cursor)
+		for _, record := range page.Records {
+			seen = append(seen, record.Sequence)
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 7 || seen[6] != 6 {
+		t.Error("pagination missed records")
+	}
+	page = getLedgerPage(t, "?limit=7")
+	if page.NextCursor != "" {
+		t.Error("cursor on exact-fit page")
+	}
+
+	// filters
+	page = getLedgerPage(t, "?type=grant,Unclaim")
+	if len(page.Records) != 2 || page.Records[0].RecType != GrantBID || page.Records[1].RecType != UnclaimBID {
+		t.Error("type filter")
+	}
+	page = getLedgerPage(t, "?bid=00000000000009a0")
+	if len(page.Records) != 2 {
+		t.Error("bid filter")
+	}
+	page = getLedgerPage(t, "?pid=Reddit.com@Q9")
+	if len(page.Records) != 1 || page.Records[0].Sequence != 5 {
+		t.Error("pid filter")
+	}
+	page = getLedgerPage(t, "?post=https://example.com/q3")
+	if len(page.Records) != 1 || page.Records[0].Sequence != 3 {
+		t.Error("post filter")
+	}
+	page = getLedgerPage(t, "?since="+midpoint.Format(time.RFC3339Nano))
+	if len(page.Records) != 1 || page.Records[0].Sequence != 6 {
+		t.Error("since filter")
+	}
+	page = getLedgerPage(t, "?until="+midpoint.Format(time.RFC3339Nano))
+	if len(page.Records) != 6 {
+		t.Error("until filter")
+	}
+	page = getLedgerPage(t, "?type=claim&limit=2&after=1")
+	if len(page.Records) != 2 || page.Records[0].Sequence != 2 || page.NextCursor != "3" {
+		t.Error("filter plus pagination")
+	}
+
+	for _, bad := range []string{"?type=Nope", "?bid=xyz", "?pid=nobody", "?since=yesterday", "?limit=0", "?after=x"} {
+		w := httptest.NewRecorder()
+		LedgerHandler(w, httptest.NewRequest("GET", "/ledger"+bad, nil))
+		if w.Code != 400 {
+			t.Error("accepted " + bad)
+		}
+	}
+}
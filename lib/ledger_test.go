@@ -4,7 +4,9 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func newPubKey() string {
@@ -14,6 +16,35 @@ func newPubKey() string {
 }
 
 func TestDatabase(t *testing.T) {
+	ledgerScenarios(t)
+}
+
+// TestDatabaseSQLite runs the same scenarios against a ledger kept in SQLite, then checks it all comes back
+func TestDatabaseSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	ledgerScenarios(t)
+	submitted := time.Date(2021, 9, 20, 17, 42, 5, 0, time.UTC)
+	err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "00000000000c0002", PIDs: []string{"twitter.com@p2"},
+		Submitter: &Submitter{Via: SubmittedViaAPI, Submission: "8b0e5c1f9a6d2e47", Submitted: submitted}})
+	if err != nil {
+		t.Fatal("claim with submitter: " + err.Error())
+	}
+
+	records := theStore.recordsSoFar()
+	reopenSQLiteLedger(t, path)
+	for i, record := range theStore.recordsSoFar() {
+		if !reflect.DeepEqual(*record, *records[i]) {
+			t.Errorf("record %d didn't survive reopening", i)
+		}
+	}
+	err = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "00000000000c0001", PIDs: []string{"twitter.com@p1"}})
+	if err != nil || theStore.recordsSoFar()[len(records)].Sequence != len(records) {
+		t.Error("can't carry on after reopening")
+	}
+}
+
+func ledgerScenarios(t *testing.T) {
 	BIDnums := []uint64{0xb1b1b1, 0xb2b2b2, 0xb3b3b3}
 	var BIDs []string
 	for _, b := range BIDnums {
@@ -122,3 +153,170 @@ func TestDatabase(t *testing.T) {
 		t.Error("not friendless")
 	}
 }
+
+// storeState copies everything an append can touch, so rejected appends can be checked for leftovers
+type storeState struct {
+	records      int
+	mappings     *bidMappings
+	keysUsed     map[string]bool
+	reservations map[string]reservation
+	tables       map[string][]string
+}
+
+func captureStoreState() storeState {
+	state := storeState{
+		records:      len(theStore.records),
+		mappings:     theStore.mappings.clone(),
+		keysUsed:     make(map[string]bool),
+		reservations: make(map[string]reservation),
+	}
+	for k, v := range theStore.keysUsed {
+		state.keysUsed[k] = v
+	}
+	for k, v := range theStore.reservations {
+		state.reservations[k] = v
+	}
+	if theStore.db != nil {
+		state.tables = make(map[string][]string)
+		for _, table := range []string{"records", "pid_bid", "used_keys", "bid_policy"} {
+			rows, err := theStore.db.db.Query("SELECT * FROM " + table)
+			if err != nil {
+				panic(err)
+			}
+			columns, _ := rows.Columns()
+			values := make([]interface{}, len(columns))
+			for i := range values {
+				values[i] = new(interface{})
+			}
+			for rows.Next() {
+				_ = rows.Scan(values...)
+				row := ""
+				for _, v := range values {
+					row += fmt.Sprint(*v.(*interface{})) + " "
+				}
+				state.tables[table] = append(state.tables[table], row)
+			}
+			_ = rows.Close()
+		}
+	}
+	return state
+}
+
+// freshSQLiteLedger swaps in a store kept in a new SQLite database. Call the returned func to put the old one back.
+func freshSQLiteLedger(t *testing.T) (string, func()) {
+	path := t.TempDir() + "/ledger.db"
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal("open: " + err.Error())
+	}
+	saved := theStore
+	theStore = serverStore(s)
+	return path, func() {
+		_ = theStore.db.close()
+		theStore = saved
+	}
+}
+
+// reopenSQLiteLedger closes the store from freshSQLiteLedger and opens the database at path again, as a restart
+// would, and checks that it all comes back the same
+func reopenSQLiteLedger(t *testing.T, path string) {
+	t.Helper()
+	before := captureStoreState()
+	_ = theStore.db.close()
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal("reopen: " + err.Error())
+	}
+	theStore = serverStore(s)
+	if !reflect.DeepEqual(captureStoreState(), before) {
+		t.Error("reopened store doesn't match")
+	}
+}
+
+// checkReplay imports the ledger so far into a new store, which checks every record again the way a replica does
+func checkReplay(t *testing.T, what string) {
+	t.Helper()
+	err := newLedgerStore().importLedger(theStore.recordsSoFar())
+	if err != nil {
+		t.Error("replaying " + what + ": " + err.Error())
+	}
+}
+
+func TestAppendRejections(t *testing.T) {
+	defer freshLedger()()
+	appendRejections(t)
+}
+
+func TestAppendRejectionsSQLite(t *testing.T) {
+	_, restore := freshSQLiteLedger(t)
+	defer restore()
+	appendRejections(t)
+}
+
+func appendRejections(t *testing.T) {
+	owned := "00000000000a0001"
+	err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: owned, PIDs: []string{"twitter.com@owner"}})
+	if err != nil {
+		t.Fatal("setup: " + err.Error())
+	}
+	usedKey := newPubKey()
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"twitter.com@owner", "reddit.com@friend"}, Key: usedKey})
+	if err != nil {
+		t.Fatal("setup: " + err.Error())
+	}
+	reserved, _, err := theStore.allocateBID("twitter.com@reserver", time.Now())
+	if err != nil {
+		t.Fatal("setup: " + err.Error())
+	}
+	spareKey := newPubKey()
+
+	rejects := []struct {
+		what   string
+		record LedgerRecord
+	}{
+		{"claim with two PIDs", LedgerRecord{RecType: ClaimBID, BID: "b0b", PIDs: []string{"twitter.com@a", "twitter.com@b"}}},
+		{"grant with one PID", LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"twitter.com@owner"}, Key: spareKey}},
+		{"bad BID", LedgerRecord{RecType: ClaimBID, BID: "not hex", PIDs: []string{"twitter.com@a"}}},
+		{"bad PID", LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"Twitter.com@Owner", "nobody"}, Key: spareKey}},
+		{"unknown type", LedgerRecord{RecType: 99, BID: "b0b", PIDs: []string{"twitter.com@a"}}},
+		{"claim of claimed BID", LedgerRecord{RecType: ClaimBID, BID: owned, PIDs: []string{"twitter.com@thief"}}},
+		{"claim of reserved BID", LedgerRecord{RecType: ClaimBID, BID: FormatBID(reserved), PIDs: []string{"twitter.com@thief"}}},
+		{"grant of unclaimed BID", LedgerRecord{RecType: GrantBID, BID: "b0b", PIDs: []string{"twitter.com@owner", "reddit.com@x"}, Key: spareKey}},
+		{"grant by unmapped PID", LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"twitter.com@thief", "reddit.com@x"}, Key: spareKey}},
+		{"grant with used key", LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"twitter.com@owner", "reddit.com@x"}, Key: usedKey}},
+		{"unclaim of unclaimed BID", LedgerRecord{RecType: UnclaimBID, BID: "b0b", PIDs: []string{"twitter.com@owner"}}},
+		{"unclaim by unmapped PID", LedgerRecord{RecType: UnclaimBID, BID: owned, PIDs: []string{"twitter.com@thief"}}},
+	}
+	for _, reject := range rejects {
+		before := captureStoreState()
+		record := reject.record
+		record.PIDs = append([]string(nil), reject.record.PIDs...)
+		err = appendToLedger(&record)
+		if err == nil {
+			t.Error(reject.what + ": accepted")
+			continue
+		}
+		if !reflect.DeepEqual(captureStoreState(), before) {
+			t.Error(reject.what + ": store changed")
+		}
+		if !reflect.DeepEqual(record, reject.record) {
+			t.Error(reject.what + ": caller's record changed")
+		}
+	}
+
+	// the key offered in all those rejected grants is still good
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: owned, PIDs: []string{"twitter.com@owner", "reddit.com@x"}, Key: spareKey})
+	if err != nil {
+		t.Error("key burned by rejected grant: " + err.Error())
+	}
+}
+
+// freshLedger swaps in an empty store, for tests that need to know everything that's in there.
+// Call the returned func to put the old one back.
+func freshLedger() func() {
+	saved := theStore
+	theStore = serverStore(newLedgerStore())
+	return func() {
+		theStore = saved
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 )
 
+// for /transfer-assertions, Granter is the owner and Accepter the new owner, and there's no Role
 type grantAssertionsRequest struct {
 	BID      string
 	Granter  string
 	Accepter string
+	Role     string // owner, the default, member, or read-only
 }
 type grantAssertionsResponse struct {
 	GrantAssertion  string
@@ -48,7 +49,13 @@ func bidAssertionHandler(w http.ResponseWriter, httpRequest *http.Request, opcod
 		return
 	}
 
-	response := bidAssertionResponse{Assertion: assertionFromFields(opcode, req.BID)}
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		http.Error(w, "Invalid BID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := bidAssertionResponse{Assertion: bidAssertion(opcode, bid)}
 	respJSON, err := json.MarshalIndent(response, "", " ")
 	if err != nil {
 		http.Error(w, "Can't generate JSON response", http.StatusInternalServerError)
@@ -63,7 +70,20 @@ func bidAssertionHandler(w http.ResponseWriter, httpRequest *http.Request, opcod
 	return
 }
 
+// bidAssertion makes the single-field Claim ("C") and Unclaim ("U") assertions
+func bidAssertion(opcode string, bid uint64) string {
+	return assertionFromFields(opcode, FormatBID(bid))
+}
+
 func GrantAssertionsHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	pairedAssertionsHandler(w, httpRequest, GrantBID)
+}
+
+func TransferAssertionsHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	pairedAssertionsHandler(w, httpRequest, TransferBID)
+}
+
+func pairedAssertionsHandler(w http.ResponseWriter, httpRequest *http.Request, recType recordType) {
 	if httpRequest.Method != "POST" {
 		http.Error(w, "Method is not supported.", http.StatusBadRequest)
 		return
@@ -75,7 +95,7 @@ func GrantAssertionsHandler(w http.ResponseWriter, httpRequest *http.Request) {
 		return
 	}
 
-	resp, problem, myFault := newGrantAssertionsResponse(body)
+	resp, problem, myFault := newPairedAssertionsResponse(body, recType)
 
 	if problem != "" {
 		if myFault {
@@ -97,6 +117,10 @@ func GrantAssertionsHandler(w http.ResponseWriter, httpRequest *http.Request) {
 
 // this is broken out so it can be tested
 func newGrantAssertionsResponse(reqBody []byte) (resp []byte, msg string, myProblem bool) {
+	return newPairedAssertionsResponse(reqBody, GrantBID)
+}
+
+func newPairedAssertionsResponse(reqBody []byte, recType recordType) (resp []byte, msg string, myProblem bool) {
 	var req grantAssertionsRequest
 	err := json.Unmarshal(reqBody, &req)
 	if err != nil {
@@ -109,13 +133,36 @@ func newGrantAssertionsResponse(reqBody []byte) (resp []byte, msg string, myProb
 		return
 	}
 
-	bid, err := strconv.ParseUint(req.BID, 16, 64)
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		msg = "Invalid BID: " + err.Error()
+		return
+	}
+	granter, err := NormalizePID(req.Granter)
+	if err != nil {
+		msg = "Invalid Granter: " + err.Error()
+		return
+	}
+	accepter, err := NormalizePID(req.Accepter)
+	if err != nil {
+		msg = "Invalid Accepter: " + err.Error()
+		return
+	}
+
+	if recType == GrantBID && req.Role == "" {
+		req.Role = RoleOwner
+	}
+	if recType == TransferBID && req.Role != "" {
+		msg = "Transfers don't have a Role"
+		return
+	}
+	gOpcode, aOpcode, err := pairedOpcodes(recType, req.Role)
 	if err != nil {
-		msg = "BID isn't a 64-bit quantity: " + err.Error()
+		msg = "Invalid Role: " + err.Error()
 		return
 	}
 
-	g, a, err := generateGrantAssertions(bid, req.Granter, req.Accepter)
+	g, a, err := generatePairedAssertions(gOpcode, aOpcode, bid, granter, accepter)
 	if err != nil {
 		myProblem = true
 		msg = "Assertion generation error: " + err.Error()
@@ -2,8 +2,6 @@ package blueskidgo
 
 import (
 	"errors"
-	"io"
-	"net/http"
 	"strings"
 )
 
@@ -14,12 +12,7 @@ func assertionFromMastodon(url string, fieldCount int) (assertionFields []string
 		return
 	}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return
-	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := fetchURL(url, nil)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,241 @@
+package blueskidgo
+
+// The PID group only looks one BID away. The PID graph follows BIDs as far as they go (or as far as it's asked to),
+//  so if A shares a BID with B and B shares another with C, A's graph includes C. Which PIDs are connected is
+//  kept up to date as records are applied: adding a PID to a BID merges its component into the BID's, the smaller
+//  into the larger, and removing one redraws just the component it was in, since that may have come apart. So a
+//  request only has to walk the component it asks about, to find how far each PID is from the one asked about.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type PIDGraphNode struct {
+	PID   string
+	Depth int
+}
+
+type PIDGraphEdge struct {
+	From string
+	To   string
+	BID  string
+}
+
+type PIDGraph struct {
+	Root          string
+	MaxDepth      int `json:",omitempty"`
+	Nodes         []PIDGraphNode
+	Edges         []PIDGraphEdge
+	Truncated     bool
+	ComponentSize int // how many PIDs are connected to Root, however far away
+}
+
+// join puts pid, just mapped to bid, in the same component as the BID's other PIDs
+func (m *bidMappings) join(bid string, pid string) {
+	label, ok := m.ComponentOf[pid]
+	if !ok {
+		label = pid
+		m.ComponentOf[pid] = label
+		m.Components[label] = map[string]bool{pid: true}
+	}
+	for other := range m.PIDsForBID[bid] {
+		// the BID's other PIDs are all in one component already
+		if other != pid {
+			if m.ComponentOf[other] != label {
+				m.merge(m.ComponentOf[other], label)
+			}
+			return
+		}
+	}
+}
+
+// merge moves the PIDs of the smaller of two components into the larger one
+func (m *bidMappings) merge(a string, b string) {
+	if len(m.Components[a]) < len(m.Components[b]) || len(m.Components[a]) == len(m.Components[b]) && b < a {
+		a, b = b, a
+	}
+	for pid := range m.Components[b] {
+		m.ComponentOf[pid] = a
+		m.Components[a][pid] = true
+	}
+	delete(m.Components, b)
+}
+
+// split redraws the component pid was in, now that it's left a BID, which may have cut the component in two. PIDs
+// left without any BIDs drop out.
+func (m *bidMappings) split(pid string) {
+	label, ok := m.ComponentOf[pid]
+	if !ok {
+		return
+	}
+	members := sortedKeys(m.Components[label])
+	delete(m.Components, label)
+	for _, member := range members {
+		delete(m.ComponentOf, member)
+	}
+	for _, member := range members {
+		if _, done := m.ComponentOf[member]; done || len(m.BIDsForPID[member]) == 0 {
+			continue
+		}
+		component := map[string]bool{member: true}
+		m.ComponentOf[member] = member
+		m.Components[member] = component
+		for frontier := []string{member}; len(frontier) > 0; {
+			next := frontier[len(frontier)-1]
+			frontier = frontier[:len(frontier)-1]
+			for bid := range m.BIDsForPID[next] {
+				for other := range m.PIDsForBID[bid] {
+					if !component[other] {
+						component[other] = true
+						m.ComponentOf[other] = member
+						frontier = append(frontier, other)
+					}
+				}
+			}
+		}
+	}
+}
+
+// component is the PIDs connected to pid, including pid
+func (m *bidMappings) component(pid string) map[string]bool {
+	if label, ok := m.ComponentOf[pid]; ok {
+		return m.Components[label]
+	}
+	return map[string]bool{pid: true}
+}
+
+// pidGraph walks out from root, through the whole of its component, or if maxDepth isn't 0, that many BIDs away.
+// Every pair of PIDs sharing a BID that the walk reaches gets an edge labeled with that BID. If there were more BIDs
+// to follow past maxDepth, Truncated is set.
+func (m *bidMappings) pidGraph(root string, maxDepth int) *PIDGraph {
+	component := m.component(root)
+	graph := &PIDGraph{Root: root, MaxDepth: maxDepth, ComponentSize: len(component)}
+	depths := make(map[string]int, len(component))
+	depths[root] = 0
+	visitedBIDs := make(map[string]bool)
+	frontier := []string{root}
+
+	for depth := 0; len(frontier) > 0; depth++ {
+		var next []string
+		for _, pid := range frontier {
+			for _, bid := range sortedKeys(m.BIDsForPID[pid]) {
+				if visitedBIDs[bid] {
+					continue
+				}
+				if depth == maxDepth && maxDepth != 0 {
+					graph.Truncated = true
+					continue
+				}
+				visitedBIDs[bid] = true
+				members := sortedKeys(m.PIDsForBID[bid])
+				for i, member := range members {
+					_, seen := depths[member]
+					if !seen {
+						depths[member] = depth + 1
+						next = append(next, member)
+					}
+					for _, other := range members[i+1:] {
+						graph.Edges = append(graph.Edges, PIDGraphEdge{From: member, To: other, BID: bid})
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+
+	for pid, depth := range depths {
+		graph.Nodes = append(graph.Nodes, PIDGraphNode{PID: pid, Depth: depth})
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		if graph.Nodes[i].Depth != graph.Nodes[j].Depth {
+			return graph.Nodes[i].Depth < graph.Nodes[j].Depth
+		}
+		return graph.Nodes[i].PID < graph.Nodes[j].PID
+	})
+	return graph
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dot renders the graph for GraphViz
+func (graph *PIDGraph) dot() string {
+	var b strings.Builder
+	b.WriteString("graph pids {\n")
+	for _, node := range graph.Nodes {
+		b.WriteString("  " + strconv.Quote(node.PID))
+		if node.PID == graph.Root {
+			b.WriteString(" [shape=doublecircle]")
+		}
+		b.WriteString(";\n")
+	}
+	for _, edge := range graph.Edges {
+		b.WriteString("  " + strconv.Quote(edge.From) + " -- " + strconv.Quote(edge.To) + " [label=" + strconv.Quote(edge.BID) + "];\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// PIDGraphHandler serves /pid-graph?pid=…, with optional depth, asOf, and format=dot. Without depth, the graph is
+// the PID's whole component.
+func PIDGraphHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	pid := httpRequest.Form.Get("pid")
+	if pid == "" {
+		http.Error(w, "missing parameter 'pid'", http.StatusBadRequest)
+		return
+	}
+	pid, err := NormalizePID(pid)
+	if err != nil {
+		http.Error(w, "invalid parameter 'pid': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	depth, err := parseGraphDepth(httpRequest.Form.Get("depth"))
+	if err != nil {
+		http.Error(w, "invalid parameter 'depth': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var graph *PIDGraph
+	err = storeFor(httpRequest).withMappingsAsOf(httpRequest.Form.Get("asOf"), func(m *bidMappings) { graph = m.pidGraph(pid, depth) })
+	if err != nil {
+		http.Error(w, "invalid parameter 'asOf': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch httpRequest.Form.Get("format") {
+	case "", "json":
+		respJSON, err := json.MarshalIndent(graph, "", " ")
+		writeJson(w, respJSON, err)
+	case "dot":
+		w.Header().Set("Content-type", "text/vnd.graphviz")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(graph.dot()))
+	default:
+		http.Error(w, "parameter 'format' must be 'json' or 'dot'", http.StatusBadRequest)
+	}
+}
+
+// parseGraphDepth returns 0, meaning no limit, if s is empty
+func parseGraphDepth(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(s)
+	if err != nil || depth < 1 {
+		return 0, errors.New("must be a positive number")
+	}
+	return depth, nil
+}
@@ -0,0 +1,164 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPIDGraph(t *testing.T) {
+	defer freshLedger()()
+
+	// a chain: A-b1-B-b2-C-b3-D, plus E sharing b1
+	chain := []string{"twitter.com@ga", "twitter.com@gb", "twitter.com@gc", "twitter.com@gd"}
+	for i := 0; i < 3; i++ {
+		bid := FormatBID(uint64(0x96b1 + i))
+		_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{chain[i]}})
+		_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{chain[i], chain[i+1]}, Key: newPubKey()})
+	}
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "96b1", PIDs: []string{"twitter.com@ga", "twitter.com@ge"}, Key: newPubKey()})
+
+	// one-hop group misses C and D
+	if len(makePIDgroup("twitter.com@ga")) != 3 {
+		t.Error("pid group changed")
+	}
+
+	graph := theStore.mappings.pidGraph("twitter.com@ga", 0)
+	if len(graph.Nodes) != 5 || graph.Truncated || graph.ComponentSize != 5 {
+		t.Errorf("%d nodes, wanted 5", len(graph.Nodes))
+	}
+	wantedDepths := map[string]int{"twitter.com@ga": 0, "twitter.com@gb": 1, "twitter.com@ge": 1, "twitter.com@gc": 2, "twitter.com@gd": 3}
+	for _, node := range graph.Nodes {
+		if wantedDepths[node.PID] != node.Depth {
+			t.Errorf("%s at depth %d", node.PID, node.Depth)
+		}
+	}
+	// b1 has three members so three edges; b2 and b3 one each
+	if len(graph.Edges) != 5 {
+		t.Errorf("%d edges, wanted 5", len(graph.Edges))
+	}
+	for _, edge := range graph.Edges {
+		if edge.From == "twitter.com@gc" && edge.To == "twitter.com@gd" && edge.BID != FormatBID(0x96b3) {
+			t.Error("wrong edge label")
+		}
+	}
+
+	// depth-limited
+	graph = theStore.mappings.pidGraph("twitter.com@ga", 2)
+	if len(graph.Nodes) != 4 || !graph.Truncated || graph.ComponentSize != 5 {
+		t.Error("depth limit not applied")
+	}
+
+	// from the middle
+	graph = theStore.mappings.pidGraph("twitter.com@gc", 1)
+	if len(graph.Nodes) != 3 || !graph.Truncated {
+		t.Error("graph from middle wrong")
+	}
+
+	// loner
+	graph = theStore.mappings.pidGraph("twitter.com@loner", 3)
+	if len(graph.Nodes) != 1 || len(graph.Edges) != 0 || graph.Truncated {
+		t.Error("loner graph wrong")
+	}
+
+	// via handler
+	w := httptest.NewRecorder()
+	PIDGraphHandler(w, httptest.NewRequest("GET", "/pid-graph?pid=Twitter.com@GA", nil))
+	var fromJSON PIDGraph
+	err := json.Unmarshal(w.Body.Bytes(), &fromJSON)
+	if err != nil || len(fromJSON.Nodes) != 5 || fromJSON.Root != "twitter.com@ga" {
+		t.Error("JSON graph wrong: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	PIDGraphHandler(w, httptest.NewRequest("GET", "/pid-graph?pid=twitter.com@ga&format=dot&depth=1", nil))
+	dot := w.Body.String()
+	if !strings.HasPrefix(dot, "graph pids {") ||
+		!strings.Contains(dot, `"twitter.com@ga" -- "twitter.com@gb" [label="00000000000096B1"];`) ||
+		strings.Contains(dot, "twitter.com@gc") {
+		t.Error("DOT graph wrong: " + dot)
+	}
+	w = httptest.NewRecorder()
+	PIDGraphHandler(w, httptest.NewRequest("GET", "/pid-graph?pid=twitter.com@ga&asOf=1", nil))
+	fromJSON = PIDGraph{}
+	_ = json.Unmarshal(w.Body.Bytes(), &fromJSON)
+	if len(fromJSON.Nodes) != 2 {
+		t.Error("asOf graph wrong: " + w.Body.String())
+	}
+	for _, bad := range []string{"?pid=twitter.com@ga&depth=0", "?pid=twitter.com@ga&depth=-1", "?pid=twitter.com@ga&format=svg", "?depth=2"} {
+		w = httptest.NewRecorder()
+		PIDGraphHandler(w, httptest.NewRequest("GET", "/pid-graph"+bad, nil))
+		if w.Code != 400 {
+			t.Error("accepted " + bad)
+		}
+	}
+}
+
+func TestPIDComponents(t *testing.T) {
+	defer freshLedger()()
+	pid := func(i int) string { return "twitter.com@pc" + strconv.Itoa(i) }
+	bid := func(i int) string { return FormatBID(uint64(0x9c00 + i)) }
+
+	// a chain longer than any depth limit used to allow
+	const length = 150
+	for i := 0; i < length; i++ {
+		_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid(i), PIDs: []string{pid(i)}})
+		_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid(i), PIDs: []string{pid(i), pid(i + 1)}, Key: newPubKey()})
+	}
+	graph := theStore.mappings.pidGraph(pid(0), 0)
+	if len(graph.Nodes) != length+1 || len(graph.Edges) != length || graph.Truncated || graph.Nodes[length].Depth != length {
+		t.Errorf("long chain: %d nodes, %d edges", len(graph.Nodes), len(graph.Edges))
+	}
+	checkComponents(t, theStore.mappings)
+
+	// cutting the chain in the middle leaves two components
+	_ = appendToLedger(&LedgerRecord{RecType: RemovePID, BID: bid(100), PIDs: []string{pid(100), pid(101)}})
+	if len(theStore.mappings.component(pid(0))) != 101 || len(theStore.mappings.component(pid(length))) != length-100 {
+		t.Error("chain not cut")
+	}
+	checkComponents(t, theStore.mappings)
+
+	// a PID with no BIDs left is on its own
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid(length - 1), PIDs: []string{pid(length)}})
+	if _, ok := theStore.mappings.ComponentOf[pid(length)]; ok || len(theStore.mappings.component(pid(length))) != 1 {
+		t.Error("PID without BIDs still in a component")
+	}
+	checkComponents(t, theStore.mappings)
+
+	// joining them up again
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid(0), PIDs: []string{pid(0), pid(length - 1)}, Key: newPubKey()})
+	if len(theStore.mappings.component(pid(101))) != length {
+		t.Error("components not merged")
+	}
+	checkComponents(t, theStore.mappings)
+
+	// replaying the ledger, from scratch or a snapshot, ends up with the same components
+	m := newBIDMappings()
+	for _, record := range theStore.recordsSoFar() {
+		m.apply(record)
+	}
+	if !reflect.DeepEqual(m, theStore.mappings) || !reflect.DeepEqual(m.clone(), m) {
+		t.Error("replayed components don't match")
+	}
+}
+
+// checkComponents compares the component index with a walk of the mappings
+func checkComponents(t *testing.T, m *bidMappings) {
+	t.Helper()
+	for pid, label := range m.ComponentOf {
+		if !m.Components[label][pid] {
+			t.Errorf("%s isn't in its component", pid)
+		}
+		walked := m.pidGraph(pid, 0)
+		if len(walked.Nodes) != len(m.Components[label]) {
+			t.Errorf("%s: %d PIDs in the component, %d reached", pid, len(m.Components[label]), len(walked.Nodes))
+		}
+	}
+	for pid, bids := range m.BIDsForPID {
+		if _, ok := m.ComponentOf[pid]; !ok && len(bids) > 0 {
+			t.Errorf("%s isn't in a component", pid)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package blueskidgo
+
+// Being polite to providers. Each host gets a token bucket, which fetchURL takes a token from before each request.
+//  It starts out as RateLimit says, and once the host sends rate-limit headers, it follows those: the limit becomes
+//  the bucket's size and the remaining count its tokens, until the host's window resets. A 429 or 5xx response
+//  blocks the host for a while, doubling each time in a row that happens, with jitter so that workers don't all
+//  come back at once, or for as long as Retry-After says. When a request would have to wait longer than
+//  MaxThrottleWait, fetchURL gives up with an UpstreamThrottledError instead.
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket's shape: Burst requests at once, refilled at PerSecond
+type RateLimit struct {
+	Burst     int
+	PerSecond float64
+}
+
+// DefaultRateLimit applies to hosts that aren't in HostRateLimits
+var DefaultRateLimit = RateLimit{Burst: 10, PerSecond: 2}
+
+// HostRateLimits is indexed by hostname. The Twitter API allows 300 tweet lookups per 15 minutes.
+var HostRateLimits = map[string]RateLimit{
+	"api.twitter.com": {Burst: 10, PerSecond: 300.0 / (15 * 60)},
+}
+
+// BackoffBase is how long a host is left alone after a 429 or 5xx; it doubles with each one in a row, up to
+// BackoffMax
+var BackoffBase = time.Second
+var BackoffMax = 5 * time.Minute
+
+// MaxThrottleWait is the longest fetchURL waits for a host before giving up with an UpstreamThrottledError
+var MaxThrottleWait = 5 * time.Second
+
+// FetchAttempts is how many times fetchURL tries a request that gets a 429 or 5xx
+var FetchAttempts = 3
+
+// UpstreamThrottledError means a provider is refusing requests or failing, with a 429 or 5xx, or would be if we
+// made them. Status is the provider's response status, or 0 if it's our own limiter doing the refusing.
+type UpstreamThrottledError struct {
+	Host       string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamThrottledError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("upstream %s throttled the request (%d), try again in %s", e.Host, e.Status, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("upstream %s is being rate-limited, try again in %s", e.Host, e.RetryAfter.Round(time.Second))
+}
+
+type hostLimiter struct {
+	lock         sync.Mutex
+	tokens       float64
+	burst        float64
+	perSecond    float64
+	last         time.Time
+	resetAt      time.Time // while the host's headers are in charge, when its window resets
+	blockedUntil time.Time
+	failures     int // 429s and 5xxs in a row
+}
+
+// hostLimiters is indexed by hostname
+var hostLimiters = make(map[string]*hostLimiter)
+var hostLimitersLock sync.Mutex
+
+func limiterFor(host string) *hostLimiter {
+	hostLimitersLock.Lock()
+	defer hostLimitersLock.Unlock()
+	l, ok := hostLimiters[host]
+	if !ok {
+		limit, ok := HostRateLimits[host]
+		if !ok {
+			limit = DefaultRateLimit
+		}
+		l = &hostLimiter{tokens: float64(limit.Burst), burst: float64(limit.Burst), perSecond: limit.PerSecond, last: time.Now()}
+		hostLimiters[host] = l
+	}
+	return l
+}
+
+// refill must be called with l locked
+func (l *hostLimiter) refill(now time.Time) {
+	if !l.resetAt.IsZero() {
+		if !now.Before(l.resetAt) {
+			l.tokens = l.burst
+			l.resetAt = time.Time{}
+		}
+	} else if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.perSecond
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// reserve takes a token, and says how long to wait before using it. If that's longer than max, it doesn't take
+// the token, and ok is false.
+func (l *hostLimiter) reserve(now time.Time, max time.Duration) (wait time.Duration, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill(now)
+	if now.Before(l.blockedUntil) {
+		wait = l.blockedUntil.Sub(now)
+	}
+	if l.tokens < 1 {
+		var next time.Duration
+		if !l.resetAt.IsZero() {
+			next = l.resetAt.Sub(now)
+		} else {
+			next = time.Duration((1 - l.tokens) / l.perSecond * float64(time.Second))
+		}
+		if next > wait {
+			wait = next
+		}
+	}
+	if wait > max {
+		return wait, false
+	}
+	l.tokens--
+	return wait, true
+}
+
+// succeeded takes note of a response that wasn't a 429 or 5xx
+func (l *hostLimiter) succeeded(now time.Time, header http.Header) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failures = 0
+	l.observe(now, header)
+}
+
+// failed takes note of a 429 or 5xx response, and returns how long the host is blocked for
+func (l *hostLimiter) failed(now time.Time, header http.Header) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failures++
+	l.observe(now, header)
+	backoff := BackoffMax
+	if l.failures < 32 && BackoffBase<<(l.failures-1) < BackoffMax {
+		backoff = BackoffBase << (l.failures - 1)
+	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if retryAfter, ok := parseRetryAfter(header.Get("Retry-After"), now); ok && retryAfter > backoff {
+		backoff = retryAfter
+	}
+	l.blockedUntil = now.Add(backoff)
+	return backoff
+}
+
+// observe reads the rate-limit headers Twitter (X-Rate-Limit-*), Mastodon (X-RateLimit-*) and others
+// (RateLimit-*) send. It must be called with l locked.
+func (l *hostLimiter) observe(now time.Time, header http.Header) {
+	for _, prefix := range []string{"X-Rate-Limit-", "X-Ratelimit-", "Ratelimit-"} {
+		limit, err := strconv.Atoi(header.Get(prefix + "Limit"))
+		if err != nil {
+			continue
+		}
+		remaining, err := strconv.Atoi(header.Get(prefix + "Remaining"))
+		if err != nil {
+			continue
+		}
+		reset, ok := parseReset(header.Get(prefix+"Reset"), now)
+		if !ok || !reset.After(now) {
+			continue
+		}
+		l.refill(now)
+		l.burst = float64(limit)
+		l.tokens = float64(remaining)
+		l.resetAt = reset
+		return
+	}
+}
+
+// parseReset reads a window reset time, which may be Unix seconds, seconds from now, or an RFC3339 timestamp
+func parseReset(s string, now time.Time) (time.Time, bool) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if seconds > 1000000000 {
+			return time.Unix(seconds, 0), true
+		}
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// parseRetryAfter reads a Retry-After header, which is either seconds or an HTTP date
+func parseRetryAfter(s string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(s); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Sub(now), true
+}
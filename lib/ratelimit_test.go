@@ -0,0 +1,188 @@
+package blueskidgo
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	l := &hostLimiter{tokens: 2, burst: 2, perSecond: 1, last: now}
+	for i := 0; i < 2; i++ {
+		wait, ok := l.reserve(now, 0)
+		if !ok || wait != 0 {
+			t.Fatalf("token %d: %s %v", i, wait, ok)
+		}
+	}
+	wait, ok := l.reserve(now, 0)
+	if ok || wait != time.Second {
+		t.Errorf("empty bucket: %s %v", wait, ok)
+	}
+	wait, ok = l.reserve(now, time.Second)
+	if !ok || wait != time.Second {
+		t.Errorf("waiting for a token: %s %v", wait, ok)
+	}
+	// that token's spoken for, so the next one is a second later
+	wait, _ = l.reserve(now, 0)
+	if wait != 2*time.Second {
+		t.Errorf("next token in %s", wait)
+	}
+
+	// headers take over until the window resets
+	header := http.Header{}
+	header.Set("X-Rate-Limit-Limit", "300")
+	header.Set("X-Rate-Limit-Remaining", "0")
+	header.Set("X-Rate-Limit-Reset", strconv.FormatInt(now.Add(time.Minute).Unix(), 10))
+	l.succeeded(now, header)
+	wait, ok = l.reserve(now.Add(30*time.Second), time.Hour)
+	if !ok || wait < 29*time.Second || wait > 30*time.Second {
+		t.Errorf("waiting for reset: %s", wait)
+	}
+	wait, _ = l.reserve(now.Add(time.Minute), 0)
+	if wait != 0 || l.tokens != 299 {
+		t.Errorf("after reset: %s %v", wait, l.tokens)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer func(base time.Duration, max time.Duration) { BackoffBase, BackoffMax = base, max }(BackoffBase, BackoffMax)
+	BackoffBase, BackoffMax = time.Second, 4*time.Second
+	now := time.Now()
+	l := &hostLimiter{tokens: 10, burst: 10, perSecond: 1, last: now}
+	for i, most := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		backoff := l.failed(now, http.Header{})
+		if backoff < most/2 || backoff > most {
+			t.Errorf("failure %d: backoff %s", i+1, backoff)
+		}
+	}
+	backoff := l.failed(now, http.Header{"Retry-After": {"120"}})
+	if backoff != 2*time.Minute {
+		t.Errorf("Retry-After ignored: %s", backoff)
+	}
+	l.succeeded(now, http.Header{})
+	if backoff = l.failed(now, http.Header{}); backoff > time.Second {
+		t.Errorf("success didn't reset backoff: %s", backoff)
+	}
+
+	for s, wanted := range map[string]time.Duration{
+		"30": 30 * time.Second,
+		now.Add(time.Hour).UTC().Format(http.TimeFormat): time.Hour,
+	} {
+		got, ok := parseRetryAfter(s, now)
+		if !ok || got < wanted-time.Second || got > wanted {
+			t.Errorf("Retry-After %s: %s", s, got)
+		}
+	}
+	for s, wanted := range map[string]time.Duration{
+		"90": 90 * time.Second,
+		strconv.FormatInt(now.Add(time.Hour).Unix(), 10): time.Hour,
+		now.Add(time.Hour).Format(time.RFC3339):          time.Hour,
+	} {
+		got, ok := parseReset(s, now)
+		if !ok || got.Sub(now) < wanted-time.Second || got.Sub(now) > wanted {
+			t.Errorf("reset %s: %s", s, got.Sub(now))
+		}
+	}
+}
+
+func TestFetchThrottling(t *testing.T) {
+	defer freshFetchCache()()
+	defer func(base time.Duration) { BackoffBase = base }(BackoffBase)
+	BackoffBase = 10 * time.Millisecond
+
+	var requests, failures int32
+	failures = 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			_, _ = w.Write([]byte("ok"))
+		case "/broken":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/last":
+			w.Header().Set("X-RateLimit-Limit", "100")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", time.Now().Add(time.Hour).Format(time.RFC3339))
+			_, _ = w.Write([]byte("ok"))
+		default:
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	// short backoffs are waited out
+	body, err := fetchURL(server.URL+"/flaky", nil)
+	if err != nil || string(body) != "ok" || requests != 3 {
+		t.Errorf("flaky: %q %v after %d requests", body, err, requests)
+	}
+
+	// a 5xx that doesn't clear up is an upstream error too, after FetchAttempts tries
+	requests = 0
+	_, err = fetchURL(server.URL+"/broken", nil)
+	var throttled *UpstreamThrottledError
+	if !errors.As(err, &throttled) || throttled.Status != http.StatusBadGateway || requests != int32(FetchAttempts) {
+		t.Errorf("broken: %v after %d requests", err, requests)
+	}
+
+	// long ones aren't, and the host is left alone until they're over
+	hostLimiters = make(map[string]*hostLimiter)
+	requests = 0
+	_, err = fetchURL(server.URL+"/throttled", nil)
+	if !errors.As(err, &throttled) || throttled.Status != http.StatusTooManyRequests || throttled.RetryAfter != time.Minute {
+		t.Errorf("throttled: %v", err)
+	}
+	_, err = fetchURL(server.URL+"/flaky", nil)
+	if !errors.As(err, &throttled) || throttled.Status != 0 || requests != 1 {
+		t.Errorf("blocked host asked again: %v after %d requests", err, requests)
+	}
+
+	// so is a host whose headers say there's nothing left
+	hostLimiters = make(map[string]*hostLimiter)
+	requests = 0
+	_, _ = fetchURL(server.URL+"/last", nil)
+	_, err = fetchURL(server.URL+"/flaky", nil)
+	if !errors.As(err, &throttled) || throttled.RetryAfter < 59*time.Minute || requests != 1 {
+		t.Errorf("exhausted host asked again: %v after %d requests", err, requests)
+	}
+}
+
+// TestThrottledSubmission checks that a throttled fetch makes a submission wait for as long as the provider asks
+func TestThrottledSubmission(t *testing.T) {
+	fetchAssertion = func(url string, fieldCount int) ([]string, string, error) {
+		return nil, "", &UpstreamThrottledError{Host: "api.twitter.com", Status: http.StatusTooManyRequests, RetryAfter: time.Hour}
+	}
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	_, _, err := recordFromPosts(ClaimBID, []string{"https://twitter.com/x/status/1"})
+	var throttled *UpstreamThrottledError
+	if !errors.As(err, &throttled) || throttled.RetryAfter != time.Hour {
+		t.Fatalf("throttling lost: %v", err)
+	}
+	s, _ := submit(ClaimBID, []string{"https://twitter.com/x/status/1"})
+	defer func() {
+		// so that it isn't picked up by later tests
+		submissionsLock.Lock()
+		delete(submissions, s.ID)
+		submissionsLock.Unlock()
+	}()
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	if s2.State != SubmissionPending || s2.Attempts != 1 {
+		t.Errorf("throttled submission: %+v", s2)
+	}
+	select {
+	case id := <-submissionQueue:
+		t.Error("retried too soon: " + id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,91 @@
+package blueskidgo
+
+// Removing a PID from a BID. A PID normally leaves a BID by unclaiming it, but if a shared account is lost or
+//  hijacked, it won't. An owner of the BID can post a Remove assertion naming the PID, which is a signed
+//  assertion, see generateSignedAssertion, with opcode K. The key that signed it goes in the Remove record and can't
+//  be used again, so the same post can't be submitted again to remove the PID after it's been granted the BID anew.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type removeAssertionRequest struct {
+	BID string
+	PID string
+}
+
+func generateRemoveAssertion(bid uint64, pid string) (string, error) {
+	return generateSignedAssertion("K", bid, pid)
+}
+
+// checkRemoveAssertion returns the BID, the PID being removed, and the key the assertion was signed with
+func checkRemoveAssertion(parts []string) (uint64, string, string, error) {
+	bid, pid, key, err := checkSignedAssertion(parts, "K", "PID Remove")
+	if err != nil {
+		return 0, "", "", err
+	}
+	pid, err = NormalizePID(pid)
+	if err != nil {
+		return 0, "", "", errors.New("bad PID in remove assertion: " + err.Error())
+	}
+	return bid, pid, key, nil
+}
+
+func removeRecordFromPost(post string) (record *LedgerRecord, retryable bool, err error) {
+	fields, pid, err := fetchAssertion(post, 6)
+	if err != nil {
+		return nil, true, fmt.Errorf("Failed to find assertion: %w", err)
+	}
+	bid, removed, key, err := checkRemoveAssertion(fields)
+	if err != nil {
+		return nil, false, errors.New("remove assertion invalid: " + err.Error())
+	}
+	record = &LedgerRecord{
+		RecType:  RemovePID,
+		BID:      FormatBID(bid),
+		PIDs:     []string{pid, removed},
+		PostURLs: []string{post},
+		Key:      key,
+	}
+	return
+}
+
+// RemoveAssertionHandler makes the assertion to post to remove a PID from a BID; it takes the BID and the PID
+func RemoveAssertionHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req removeAssertionRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		http.Error(w, "Invalid BID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pid, err := NormalizePID(req.PID)
+	if err != nil {
+		http.Error(w, "Invalid PID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := generateRemoveAssertion(bid, pid)
+	if err != nil {
+		http.Error(w, "Assertion generation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respJSON, err := json.MarshalIndent(bidAssertionResponse{Assertion: assertion}, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// RemovePIDHandler queues a submission of a posted Remove assertion
+func RemovePIDHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, RemovePID)
+}
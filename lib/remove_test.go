@@ -0,0 +1,155 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	defer freshLedger()()
+	removeScenarios(t)
+}
+
+func TestRemoveSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	removeScenarios(t)
+	reopenSQLiteLedger(t, path)
+}
+
+func removeScenarios(t *testing.T) {
+	bid := "000000000000C001"
+	owner, coOwner, member, lost := "twitter.com@rm1", "reddit.com@rm2", "tumblr.com@rm3", "reddit.com@lost"
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{owner}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{owner, coOwner}, Key: newPubKey(), Role: RoleOwner})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{owner, member}, Key: newPubKey(), Role: RoleMember})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{owner, lost}, Key: newPubKey(), Role: RoleMember})
+	remove := func(by string, pid string, key string) error {
+		return appendToLedger(&LedgerRecord{RecType: RemovePID, BID: bid, PIDs: []string{by, pid}, PostURLs: []string{"https://example.com/k"}, Key: key})
+	}
+
+	key := newPubKey()
+	for _, reject := range []struct {
+		what string
+		err  error
+	}{
+		{"remove by member", remove(member, lost, newPubKey())},
+		{"remove by outsider", remove("twitter.com@nobody", lost, newPubKey())},
+		{"remove of unmapped PID", remove(owner, "twitter.com@nobody", newPubKey())},
+		{"remove of self", remove(owner, owner, newPubKey())},
+		{"remove with one PID", appendToLedger(&LedgerRecord{RecType: RemovePID, BID: bid, PIDs: []string{owner}, Key: newPubKey()})},
+	} {
+		if reject.err == nil {
+			t.Error(reject.what + ": accepted")
+		}
+	}
+
+	err := remove(owner, lost, key)
+	if err != nil {
+		t.Fatal("remove: " + err.Error())
+	}
+	if theStore.isMapped(bid, lost) || len(theStore.bidsForPID(lost)) != 0 {
+		t.Error("removed PID still mapped")
+	}
+	if !reflect.DeepEqual(theStore.pidsForBID(bid), []string{coOwner, member, owner}) {
+		t.Errorf("wrong PIDs left: %v", theStore.pidsForBID(bid))
+	}
+
+	// the key can't be used again, even once the PID is back
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{owner, lost}, Key: newPubKey(), Role: RoleMember})
+	err = remove(coOwner, lost, key)
+	if err == nil || !strings.Contains(err.Error(), "public key") {
+		t.Errorf("remove replayed: %v", err)
+	}
+
+	// owners can remove owners
+	err = remove(coOwner, owner, newPubKey())
+	if err != nil {
+		t.Error("owner can't remove owner: " + err.Error())
+	}
+
+	w := httptest.NewRecorder()
+	PIDHistoryHandler(w, httptest.NewRequest("GET", "/pid-history?pid="+lost, nil))
+	var history historyResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history.History) != 3 || history.History[1].RecType != RemovePID || history.History[1].PIDs[0] != owner {
+		t.Error("pid-history doesn't show the removal: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	BIDHistoryHandler(w, httptest.NewRequest("GET", "/bid-history?bid="+bid, nil))
+	history = historyResponse{}
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	removes := 0
+	for _, record := range history.History {
+		if record.RecType == RemovePID {
+			removes++
+		}
+	}
+	if removes != 2 {
+		t.Error("bid-history doesn't show the removals: " + w.Body.String())
+	}
+}
+
+func TestRemoveAssertion(t *testing.T) {
+	assertion, err := generateRemoveAssertion(0xc002, "reddit.com@gone")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fields, _ := findBlueskidAssertion(assertion, 6)
+	bid, pid, key, err := checkRemoveAssertion(fields)
+	if err != nil || bid != 0xc002 || pid != "reddit.com@gone" || key != fields[ClaimKey] {
+		t.Errorf("round trip failed: %v", err)
+	}
+	swapped := append([]string(nil), fields...)
+	swapped[ClaimCounterparty] = "reddit.com@innocent"
+	_, _, _, err = checkRemoveAssertion(swapped)
+	if err == nil {
+		t.Error("accepted a remove assertion with the PID swapped")
+	}
+	revoke, _ := generateRevokeAssertion(0xc002, newPubKey())
+	fields, _ = findBlueskidAssertion(revoke, 6)
+	_, _, _, err = checkRemoveAssertion(fields)
+	if err == nil {
+		t.Error("accepted a revoke assertion as a remove assertion")
+	}
+
+	w := httptest.NewRecorder()
+	RemoveAssertionHandler(w, httptest.NewRequest("POST", "/remove-assertion", strings.NewReader(`{"BID":"c002","PID":"Reddit.com@Gone"}`)))
+	var resp bidAssertionResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	fields, err = findBlueskidAssertion(resp.Assertion, 6)
+	if w.Code != 200 || err != nil || fields[ClaimCounterparty] != "reddit.com@gone" {
+		t.Error("remove-assertion: " + w.Body.String())
+	}
+}
+
+func TestRemoveSubmission(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "c003", PIDs: []string{"twitter.com@rs1"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "c003", PIDs: []string{"twitter.com@rs1", "reddit.com@rs2"}, Key: newPubKey()})
+	assertion, _ := generateRemoveAssertion(0xc003, "reddit.com@rs2")
+	fakePosts["https://example.com/remove"] = fakePost{"twitter.com@rs1", "bye " + assertion}
+	fakePosts["https://example.com/remove-by-victim"] = fakePost{"reddit.com@rs3", assertion}
+
+	s, _ := submit(RemovePID, []string{"https://example.com/remove-by-victim"})
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	if s2.State != SubmissionRejected {
+		t.Error("remove posted by a non-owner accepted")
+	}
+	s, _ = submit(RemovePID, []string{"https://example.com/remove"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Fatal("remove not accepted: " + s2.Reason)
+	}
+	if theStore.isMapped("000000000000C003", "reddit.com@rs2") {
+		t.Error("remove didn't unmap the PID")
+	}
+}
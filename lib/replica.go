@@ -0,0 +1,162 @@
+package blueskidgo
+
+// Read replicas. One server, the primary, accepts appends. A replica tails the primary's /ledger/stream, checks
+//  that each record chains on to the ones it already has and passes the usual append checks, and appends it to
+//  its own store, which rebuilds its own mappings. It answers queries from that store and sends anything that
+//  would change the ledger to the primary.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicaRetry is how long a replica waits before reconnecting to the primary after losing it
+var ReplicaRetry = 5 * time.Second
+
+type Replica struct {
+	Primary string
+	store   *ledgerStore
+	client  *http.Client
+
+	lock    sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	err     error
+}
+
+// NewReplica makes a replica of the server at primary (e.g. "http://primary.example.com:8123"), kept in theStore
+func NewReplica(primary string) *Replica {
+	return newReplica(primary, theStore)
+}
+
+func newReplica(primary string, store *ledgerStore) *Replica {
+	return &Replica{Primary: strings.TrimSuffix(primary, "/"), store: store, client: &http.Client{}}
+}
+
+// divergedError means that the primary sent something this replica can't append, and following it any further
+// would make things worse
+type divergedError struct {
+	err error
+}
+
+func (e divergedError) Error() string {
+	return "replica has diverged from primary: " + e.err.Error()
+}
+
+// Start starts following the primary in the background
+func (r *Replica) Start() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.stopped = make(chan struct{})
+	r.err = nil
+	go r.run(ctx, r.stopped)
+}
+
+// Stop stops following the primary; the replica still answers queries
+func (r *Replica) Stop() {
+	r.lock.Lock()
+	cancel, stopped := r.cancel, r.stopped
+	r.lock.Unlock()
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+}
+
+// Err says why the replica gave up following the primary, if it has
+func (r *Replica) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Replica) run(ctx context.Context, stopped chan struct{}) {
+	defer close(stopped)
+	for {
+		err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("replica: following %s: %s", r.Primary, err.Error())
+		var diverged divergedError
+		if errors.As(err, &diverged) {
+			r.lock.Lock()
+			r.err = err
+			r.lock.Unlock()
+			return
+		}
+		select {
+		case <-time.After(ReplicaRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow reads the primary's ledger stream, starting after the last record we have, until something goes wrong
+func (r *Replica) follow(ctx context.Context) error {
+	from := len(r.store.recordsSoFar())
+	req, err := http.NewRequestWithContext(ctx, "GET", r.Primary+"/ledger/stream?from="+strconv.Itoa(from), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("ledger stream: " + resp.Status)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data string
+	for lines.Scan() {
+		line := lines.Text()
+		switch {
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var record LedgerRecord
+			err = json.Unmarshal([]byte(data), &record)
+			if err != nil {
+				return divergedError{errors.New("unreadable record: " + err.Error())}
+			}
+			err = r.store.replicate(&record)
+			if err != nil {
+				return divergedError{err}
+			}
+			data = ""
+		}
+	}
+	if lines.Err() != nil {
+		return lines.Err()
+	}
+	return errors.New("primary closed the ledger stream")
+}
+
+// Serve wraps a handler that reads the ledger so that it answers from the replica's store
+func (r *Replica) Serve(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, httpRequest *http.Request) {
+		ctx := context.WithValue(httpRequest.Context(), storeKey{}, r.store)
+		handler(w, httpRequest.WithContext(ctx))
+	}
+}
+
+// RedirectToPrimary handles requests that only the primary can, such as submitting posts for the ledger. 307
+// tells the client to repeat the request, method and body and all, at the primary.
+func (r *Replica) RedirectToPrimary(w http.ResponseWriter, httpRequest *http.Request) {
+	w.Header().Set("Location", r.Primary+httpRequest.URL.RequestURI())
+	w.WriteHeader(http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,196 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the ledger endpoints, from theStore if replica is nil, otherwise the way a replica does
+func newTestServer(replica *Replica) *httptest.Server {
+	read := func(handler http.HandlerFunc) http.HandlerFunc { return handler }
+	write := read
+	if replica != nil {
+		read = replica.Serve
+		write = func(http.HandlerFunc) http.HandlerFunc { return replica.RedirectToPrimary }
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/claim-bid", write(ClaimBIDHandler))
+	mux.HandleFunc("/allocate-bid", write(AllocateBIDHandler))
+	mux.HandleFunc("/pids-for-bid", read(GetPIDsForBIDHandler))
+	mux.HandleFunc("/pid-group", read(GetPIDGroupHandler))
+	mux.HandleFunc("/ledger", read(LedgerHandler))
+	mux.HandleFunc("/ledger/stream", read(LedgerStreamHandler))
+	return httptest.NewServer(mux)
+}
+
+func waitForRecords(t *testing.T, s *ledgerStore, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.recordsSoFar()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica has %d records, wanted %d", len(s.recordsSoFar()), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer freshLedger()()
+	hook, restoreHooks := queueingWebhook()
+	defer restoreHooks()
+	primary := newTestServer(nil)
+	defer primary.Close()
+
+	claim := func(bid string, pid string) {
+		err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{pid}})
+		if err != nil {
+			t.Fatal("claim: " + err.Error())
+		}
+	}
+	claim("00000000000d0001", "twitter.com@rep1")
+	claim("00000000000d0002", "twitter.com@rep2")
+
+	// one replica starts from scratch, the other from a copy of the ledger kept in SQLite
+	var replicas []*Replica
+	var servers []*httptest.Server
+	sqliteStore, err := openSQLiteStore(t.TempDir() + "/replica.db")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = sqliteStore.db.close() }()
+	// as when NewReplica follows with theStore, they'd announce anything they took appends for themselves
+	for _, store := range []*ledgerStore{serverStore(newLedgerStore()), serverStore(sqliteStore)} {
+		replica := newReplica(primary.URL+"/", store)
+		replica.Start()
+		defer replica.Stop()
+		server := newTestServer(replica)
+		defer server.Close()
+		replicas = append(replicas, replica)
+		servers = append(servers, server)
+	}
+
+	// records appended before and after the replicas started all arrive
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "00000000000d0001", PIDs: []string{"twitter.com@rep1", "reddit.com@rep3"}, Key: newPubKey()})
+	if err != nil {
+		t.Fatal("grant: " + err.Error())
+	}
+	err = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: "00000000000d0002", PIDs: []string{"twitter.com@rep2"}})
+	if err != nil {
+		t.Fatal("unclaim: " + err.Error())
+	}
+	records := theStore.recordsSoFar()
+	for i, replica := range replicas {
+		waitForRecords(t, replica.store, len(records))
+		if !reflect.DeepEqual(replica.store.recordsSoFar(), records) {
+			t.Errorf("replica %d has different records", i)
+		}
+		var primaryMappings, replicaMappings *bidMappings
+		theStore.readMappings(func(m *bidMappings) { primaryMappings = m.clone() })
+		replica.store.readMappings(func(m *bidMappings) { replicaMappings = m.clone() })
+		if !reflect.DeepEqual(primaryMappings, replicaMappings) {
+			t.Errorf("replica %d has different mappings", i)
+		}
+	}
+
+	// reads are answered by the replica
+	resp, err := http.Get(servers[0].URL + "/pids-for-bid?bid=d0001")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var pids getPIDsForBIDResponse
+	_ = json.NewDecoder(resp.Body).Decode(&pids)
+	_ = resp.Body.Close()
+	if !reflect.DeepEqual(pids.PIDs, []string{"reddit.com@rep3", "twitter.com@rep1"}) {
+		t.Errorf("replica answered %v", pids.PIDs)
+	}
+
+	// writes are sent to the primary
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = noFollow.Post(servers[1].URL+"/claim-bid", "application/json", strings.NewReader(`{"Post": "https://example.com/x"}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != primary.URL+"/claim-bid" {
+		t.Errorf("write not redirected: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, err = http.Post(servers[1].URL+"/allocate-bid", "application/json", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("redirected allocate failed: %d", resp.StatusCode)
+	}
+
+	// a replica that stops picks up where it left off
+	replicas[1].Stop()
+	claim("00000000000d0003", "twitter.com@rep4")
+	replicas[1].Start()
+	waitForRecords(t, replicas[1].store, len(records)+1)
+	if !sqliteStore.isMapped("00000000000D0003", "twitter.com@rep4") {
+		t.Error("restarted replica missed a record")
+	}
+	// only the primary announced the appends
+	if len(hook.events) != len(records)+1 {
+		t.Errorf("%d events for %d appends", len(hook.events), len(records)+1)
+	}
+	for _, replica := range replicas {
+		if replica.Err() != nil {
+			t.Error("replica gave up: " + replica.Err().Error())
+		}
+	}
+}
+
+func TestReplicaDivergence(t *testing.T) {
+	defer freshLedger()()
+	err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "00000000000e0001", PIDs: []string{"twitter.com@div1"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	good := *theStore.recordsSoFar()[0]
+
+	tampered := good
+	tampered.PIDs = []string{"twitter.com@mallory"}
+	outOfOrder := good
+	outOfOrder.Sequence = 5
+	illegal := LedgerRecord{RecType: UnclaimBID, BID: good.BID, PIDs: []string{"twitter.com@nobody"}, Sequence: 1, When: good.When}
+	illegal.Hash = recordHash(good.Hash, &illegal)
+
+	for _, test := range []struct {
+		what    string
+		records []LedgerRecord
+	}{
+		{"tampered record", []LedgerRecord{tampered}},
+		{"out-of-order record", []LedgerRecord{outOfOrder}},
+		{"record that breaks the rules", []LedgerRecord{good, illegal}},
+	} {
+		fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-type", "text/event-stream")
+			for _, record := range test.records {
+				data, _ := json.Marshal(&record)
+				_, _ = fmt.Fprintf(w, "id: %d\nevent: append\ndata: %s\n\n", record.Sequence, data)
+			}
+		}))
+		store := newLedgerStore()
+		replica := newReplica(fake.URL, store)
+		replica.Start()
+		deadline := time.Now().Add(5 * time.Second)
+		for replica.Err() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		replica.Stop()
+		fake.Close()
+		if replica.Err() == nil {
+			t.Error(test.what + ": not detected")
+		}
+		if len(store.recordsSoFar()) != len(test.records)-1 {
+			t.Error(test.what + ": appended anyway")
+		}
+	}
+}
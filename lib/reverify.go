@@ -0,0 +1,227 @@
+package blueskidgo
+
+// Posts get deleted and edited. Every so often, we go back and re-fetch the posts backing the BID/PID mappings that
+//  are currently in effect, and flag the ones that have gone missing or no longer say what they said. Depending on
+//  policy, a mapping whose backing post stays broken for long enough is unclaimed. A post that just can't be fetched
+//  at the moment, because the provider is down or throttling us, is flagged, but doesn't count towards that. In a
+//  cluster, only the leader re-verifies, since only it can append the Unclaims.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ReverifyPolicy string
+
+const (
+	ReverifyFlagOnly    ReverifyPolicy = "flag"
+	ReverifyAutoUnclaim ReverifyPolicy = "unclaim"
+)
+
+// ReverifyStrikes is how many consecutive re-verifications that find the post gone or changed it takes before a
+// mapping is auto-unclaimed. One might just be the provider having a bad day.
+var ReverifyStrikes = 3
+
+type ReverifyFlag struct {
+	Position     int
+	Record       *LedgerRecord
+	Problem      string
+	Strikes      int
+	FirstFlagged time.Time
+	LastChecked  time.Time
+	Unclaimed    bool
+}
+
+// reverifyFlags is indexed by ledger position
+var reverifyFlags = make(map[int]*ReverifyFlag)
+var reverifyLock sync.Mutex
+
+func ParseReverifyPolicy(s string) (ReverifyPolicy, error) {
+	switch ReverifyPolicy(s) {
+	case ReverifyFlagOnly, ReverifyAutoUnclaim:
+		return ReverifyPolicy(s), nil
+	}
+	return "", errors.New("reverify policy must be '" + string(ReverifyFlagOnly) + "' or '" + string(ReverifyAutoUnclaim) + "'")
+}
+
+// StartReverifier re-verifies the ledger every interval, forever
+func StartReverifier(interval time.Duration, policy ReverifyPolicy) {
+	go func() {
+		for range time.Tick(interval) {
+			reverifyLedger(policy)
+		}
+	}()
+}
+
+// backingFinder is a LedgerScanner that figures out which record established each BID/PID mapping that is
+// still in effect. A Claim backs its claimer's mapping, a Grant backs its accepter's, and an Unclaim, a Remove, or
+// a Revoke ends them.
+type backingFinder struct {
+	backing map[string]int
+	records map[int]*LedgerRecord
+}
+
+func (b *backingFinder) processRecord(record *LedgerRecord) error {
+	position := record.Sequence
+	subject := record.PIDs[len(record.PIDs)-1]
+	key := record.BID + " " + subject
+	if record.RecType == RevokeKey {
+		for _, pid := range record.PIDs[1:] {
+			b.unback(record.BID + " " + pid)
+		}
+		return nil
+	}
+	switch record.RecType {
+	case ClaimBID, GrantBID:
+		b.backing[key] = position
+		b.records[position] = record
+	case TransferBID:
+		// a Transfer only backs the new owner's mapping if it's what made it
+		_, ok := b.backing[key]
+		if !ok {
+			b.backing[key] = position
+			b.records[position] = record
+		}
+	case UnclaimBID, RemovePID:
+		b.unback(key)
+	}
+	return nil
+}
+
+func (b *backingFinder) unback(key string) {
+	backer, ok := b.backing[key]
+	if ok {
+		delete(b.records, backer)
+		delete(b.backing, key)
+	}
+}
+
+func reverifyLedger(policy ReverifyPolicy) {
+	if !theStore.leading() {
+		return
+	}
+	finder := backingFinder{backing: make(map[string]int), records: make(map[int]*LedgerRecord)}
+	err := Scan(&finder)
+	if err != nil {
+		log.Println("reverify: scan failed: " + err.Error())
+		return
+	}
+
+	for position, record := range finder.records {
+		problem, definitive := recheckRecord(record)
+		flag := noteRecheck(position, record, problem, definitive, time.Now().UTC())
+		if flag == nil {
+			continue
+		}
+		log.Printf("reverify: record %d (%s %s): %s", position, recTypeNames[record.RecType], record.BID, problem)
+		if policy == ReverifyAutoUnclaim && flag.Strikes >= ReverifyStrikes {
+			autoUnclaim(flag)
+		}
+	}
+
+	// anything flagged that no longer backs a mapping doesn't need to stay flagged
+	reverifyLock.Lock()
+	for position, flag := range reverifyFlags {
+		_, stillBacking := finder.records[position]
+		if !stillBacking && !flag.Unclaimed {
+			delete(reverifyFlags, position)
+		}
+	}
+	reverifyLock.Unlock()
+}
+
+// recheckRecord returns "" if the posts still say what they said when the record was appended. If not, definitive
+// is true if a post has gone or changed, as opposed to just not being fetched this time.
+func recheckRecord(record *LedgerRecord) (problem string, definitive bool) {
+	fresh, retryable, err := recordFromPosts(submissionType(record.RecType), record.PostURLs)
+	if err != nil {
+		var gone *PostGoneError
+		var noAssertion *assertionTextError
+		return err.Error(), !retryable || errors.As(err, &gone) || errors.As(err, &noAssertion)
+	}
+	err = normalizeRecord(fresh)
+	if err != nil {
+		return err.Error(), true
+	}
+	if fresh.BID != record.BID || fresh.Key != record.Key || len(fresh.PIDs) != len(record.PIDs) {
+		return "assertion has changed", true
+	}
+	for i := range fresh.PIDs {
+		if fresh.PIDs[i] != record.PIDs[i] {
+			return "assertion has changed", true
+		}
+	}
+	return "", false
+}
+
+// noteRecheck updates the flag table, and returns the flag if there's a problem. Only a definitive problem is a
+// strike.
+func noteRecheck(position int, record *LedgerRecord, problem string, definitive bool, now time.Time) *ReverifyFlag {
+	reverifyLock.Lock()
+	defer reverifyLock.Unlock()
+	if problem == "" {
+		delete(reverifyFlags, position)
+		return nil
+	}
+	flag, ok := reverifyFlags[position]
+	if !ok {
+		flag = &ReverifyFlag{Position: position, Record: record, FirstFlagged: now}
+		reverifyFlags[position] = flag
+	}
+	flag.Problem = problem
+	if definitive {
+		flag.Strikes++
+	}
+	flag.LastChecked = now
+	c := *flag
+	return &c
+}
+
+// autoUnclaim appends an Unclaim on behalf of the PID whose mapping the broken record established. The Unclaim's
+// post is the one that went bad.
+func autoUnclaim(flag *ReverifyFlag) {
+	subject := flag.Record.PIDs[len(flag.Record.PIDs)-1]
+	var posts []string
+	if len(flag.Record.PostURLs) > 0 {
+		posts = flag.Record.PostURLs[len(flag.Record.PostURLs)-1:]
+	}
+	err := appendToLedger(&LedgerRecord{
+		RecType:   UnclaimBID,
+		BID:       flag.Record.BID,
+		PIDs:      []string{subject},
+		PostURLs:  posts,
+		Submitter: &Submitter{Via: SubmittedByReverifier, Submitted: time.Now()},
+	})
+	if err != nil {
+		log.Println("reverify: auto-unclaim failed: " + err.Error())
+		return
+	}
+	reverifyLock.Lock()
+	reverifyFlags[flag.Position].Unclaimed = true
+	reverifyLock.Unlock()
+}
+
+type reverifyFlagsResponse struct {
+	Flags []ReverifyFlag
+}
+
+func ReverifyFlagsHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	var resp reverifyFlagsResponse
+	reverifyLock.Lock()
+	for _, flag := range reverifyFlags {
+		resp.Flags = append(resp.Flags, *flag)
+	}
+	reverifyLock.Unlock()
+	sort.Slice(resp.Flags, func(i, j int) bool { return resp.Flags[i].Position < resp.Flags[j].Position })
+
+	respJSON, err := json.MarshalIndent(resp, "", " ")
+	writeJson(w, respJSON, err)
+}
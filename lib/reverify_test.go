@@ -0,0 +1,120 @@
+package blueskidgo
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverify(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+	rememberFlags := reverifyFlags
+	reverifyFlags = make(map[int]*ReverifyFlag)
+	defer func() { reverifyFlags = rememberFlags }()
+
+	bid := uint64(0x4e4e4e)
+	claim := "https://example.com/rv-claim"
+	grant := "https://example.com/rv-grant"
+	accept := "https://example.com/rv-accept"
+	fakePosts[claim] = fakePost{"twitter.com@rv1", bidAssertion("C", bid)}
+	g, a, _ := generateGrantAssertions(bid, "twitter.com@rv1", "reddit.com@rv2")
+	fakePosts[grant] = fakePost{"twitter.com@rv1", g}
+	fakePosts[accept] = fakePost{"reddit.com@rv2", a}
+
+	for _, posts := range [][]string{{claim}, {grant, accept}} {
+		recType := submissionType(ClaimBID)
+		if len(posts) == 2 {
+			recType = GrantBID
+		}
+		record, _, err := recordFromPosts(recType, posts)
+		if err != nil {
+			t.Fatal("setup: " + err.Error())
+		}
+		err = appendToLedger(record)
+		if err != nil {
+			t.Fatal("setup: " + err.Error())
+		}
+	}
+
+	// all good
+	reverifyLedger(ReverifyFlagOnly)
+	if len(reverifyFlags) != 0 {
+		t.Error("flagged good records")
+	}
+
+	// accept post disappears
+	delete(fakePosts, accept)
+	reverifyLedger(ReverifyFlagOnly)
+	flag, ok := reverifyFlags[1]
+	if !ok || len(reverifyFlags) != 1 {
+		t.Fatal("missing post not flagged")
+	}
+	if flag.Strikes != 1 || !strings.Contains(flag.Problem, "404") {
+		t.Error("wrong flag: " + flag.Problem)
+	}
+
+	// comes back
+	fakePosts[accept] = fakePost{"reddit.com@rv2", a}
+	reverifyLedger(ReverifyFlagOnly)
+	if len(reverifyFlags) != 0 {
+		t.Error("flag not cleared when post came back")
+	}
+
+	// posts that can't be fetched for now are flagged, but that's not a strike against them
+	fetchAssertion = func(url string, fieldCount int) ([]string, string, error) {
+		return nil, "", &UpstreamThrottledError{Host: "example.com", Status: 503, RetryAfter: time.Minute}
+	}
+	for i := 0; i < ReverifyStrikes; i++ {
+		reverifyLedger(ReverifyAutoUnclaim)
+	}
+	fetchAssertion = fakeFetch
+	if len(reverifyFlags) != 2 || reverifyFlags[0].Strikes != 0 || len(theStore.recordsSoFar()) != 2 {
+		t.Errorf("throttled fetches counted: %+v", reverifyFlags[0])
+	}
+
+	// claim post gets edited to claim something else
+	fakePosts[claim] = fakePost{"twitter.com@rv1", bidAssertion("C", bid+1)}
+	for i := 0; i < ReverifyStrikes; i++ {
+		reverifyLedger(ReverifyFlagOnly)
+	}
+	flag, ok = reverifyFlags[0]
+	if !ok || flag.Problem != "assertion has changed" || flag.Strikes != ReverifyStrikes {
+		t.Error("changed post not flagged")
+	}
+	if !theStore.isMapped(FormatBID(bid), "twitter.com@rv1") {
+		t.Error("flag-only policy unclaimed")
+	}
+
+	w := httptest.NewRecorder()
+	ReverifyFlagsHandler(w, httptest.NewRequest("GET", "/reverify-flags", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "assertion has changed") {
+		t.Error("flags not reported: " + w.Body.String())
+	}
+
+	// unclaim policy
+	reverifyLedger(ReverifyAutoUnclaim)
+	if theStore.isMapped(FormatBID(bid), "twitter.com@rv1") {
+		t.Error("auto-unclaim didn't")
+	}
+	if !theStore.isMapped(FormatBID(bid), "reddit.com@rv2") {
+		t.Error("auto-unclaim took out the wrong PID")
+	}
+	records := theStore.recordsSoFar()
+	last := records[len(records)-1]
+	if last.RecType != UnclaimBID || last.PIDs[0] != "twitter.com@rv1" || last.PostURLs[0] != claim {
+		t.Error("wrong auto-unclaim record")
+	}
+	if !reverifyFlags[0].Unclaimed {
+		t.Error("flag doesn't show auto-unclaim")
+	}
+
+	// no longer backing anything, so not rechecked or re-unclaimed
+	before := len(theStore.recordsSoFar())
+	reverifyLedger(ReverifyAutoUnclaim)
+	if len(theStore.recordsSoFar()) != before {
+		t.Error("unclaimed twice")
+	}
+}
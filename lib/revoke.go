@@ -0,0 +1,159 @@
+package blueskidgo
+
+// Revoking a grant key. keysUsed stops a key from being used twice, but if a key leaks, whoever has it may already
+//  have used it. A PID still mapped to the BID can post a Revoke assertion naming the key; once that's in the
+//  ledger, the key is marked revoked, and the mapping its Grant established is undone, along with any mappings
+//  granted or transferred onward by PIDs that only got the BID that way.
+// A Revoke assertion is a signed assertion, see generateSignedAssertion, with opcode R, naming the revoked key.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type revokeAssertionRequest struct {
+	BID string
+	Key string
+}
+
+// revocation works out, from the ledger so far, which Grant of bid used key, and which PIDs revoking it unmaps:
+// the Grant's accepter, if that Grant is still why it's mapped, and anyone granted the BID since by a PID being
+// unmapped, again if that's still why they're mapped. It must be called with the store locked.
+func (s *ledgerStore) revocation(bid string, key string) (grant *LedgerRecord, unmapped []string) {
+	// for each PID mapped to bid, the record that mapped it
+	mappedBy := make(map[string]*LedgerRecord)
+	for _, record := range s.records {
+		if record.BID != bid {
+			continue
+		}
+		switch record.RecType {
+		case ClaimBID:
+			mappedBy[record.PIDs[0]] = record
+		case GrantBID, TransferBID:
+			if mappedBy[record.PIDs[1]] == nil {
+				mappedBy[record.PIDs[1]] = record
+			}
+			if record.RecType == GrantBID && record.Key == key {
+				grant = record
+			}
+		case UnclaimBID:
+			delete(mappedBy, record.PIDs[0])
+		case RemovePID:
+			delete(mappedBy, record.PIDs[1])
+		case RevokeKey:
+			for _, pid := range record.PIDs[1:] {
+				delete(mappedBy, pid)
+			}
+		}
+	}
+	if grant == nil {
+		return nil, nil
+	}
+
+	tainted := make(map[string]bool)
+	if mappedBy[grant.PIDs[1]] == grant {
+		tainted[grant.PIDs[1]] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for pid, record := range mappedBy {
+			if tainted[pid] || record.RecType == ClaimBID || !tainted[record.PIDs[0]] {
+				continue
+			}
+			// the granter must have made this grant after getting the BID the tainted way
+			if record.Sequence > mappedBy[record.PIDs[0]].Sequence {
+				tainted[pid] = true
+				changed = true
+			}
+		}
+	}
+	return grant, sortedKeys(tainted)
+}
+
+// revokedKeysAmong returns the keys of the Grants in records that have been revoked since
+func (s *ledgerStore) revokedKeysAmong(records []*LedgerRecord) []string {
+	revoked := make(map[string]bool)
+	s.readMappings(func(m *bidMappings) {
+		for _, record := range records {
+			if record.RecType == GrantBID && m.RevokedKeys[record.BID][record.Key] {
+				revoked[record.Key] = true
+			}
+		}
+	})
+	return sortedKeys(revoked)
+}
+
+func generateRevokeAssertion(bid uint64, revokedKey string) (string, error) {
+	return generateSignedAssertion("R", bid, revokedKey)
+}
+
+// checkRevokeAssertion returns the BID and the key being revoked
+func checkRevokeAssertion(parts []string) (uint64, string, error) {
+	bid, revokedKey, _, err := checkSignedAssertion(parts, "R", "key Revoke")
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = StringToKey(revokedKey)
+	if err != nil {
+		return 0, "", errors.New("can't parse revoked key in revoke assertion: " + err.Error())
+	}
+	return bid, revokedKey, nil
+}
+
+func revokeRecordFromPost(post string) (record *LedgerRecord, retryable bool, err error) {
+	fields, pid, err := fetchAssertion(post, 6)
+	if err != nil {
+		return nil, true, fmt.Errorf("Failed to find assertion: %w", err)
+	}
+	bid, key, err := checkRevokeAssertion(fields)
+	if err != nil {
+		return nil, false, errors.New("revoke assertion invalid: " + err.Error())
+	}
+	record = &LedgerRecord{
+		RecType:  RevokeKey,
+		BID:      FormatBID(bid),
+		PIDs:     []string{pid},
+		PostURLs: []string{post},
+		Key:      key,
+	}
+	return
+}
+
+// RevokeAssertionHandler makes the assertion to post to revoke a grant key; it takes the BID and the key
+func RevokeAssertionHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req revokeAssertionRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bid, err := ParseBID(req.BID)
+	if err != nil {
+		http.Error(w, "Invalid BID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = StringToKey(req.Key)
+	if err != nil {
+		http.Error(w, "Invalid Key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	assertion, err := generateRevokeAssertion(bid, req.Key)
+	if err != nil {
+		http.Error(w, "Assertion generation error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respJSON, err := json.MarshalIndent(bidAssertionResponse{Assertion: assertion}, "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// RevokeKeyHandler queues a submission of a posted Revoke assertion
+func RevokeKeyHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	bidUpdateHandler(w, httpRequest, RevokeKey)
+}
@@ -0,0 +1,190 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRevocation(t *testing.T) {
+	defer freshLedger()()
+	revocationScenarios(t)
+
+	// replicas and imports work out the same unmappings
+	checkReplay(t, "revocations")
+}
+
+func TestRevocationSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	revocationScenarios(t)
+	reopenSQLiteLedger(t, path)
+}
+
+func revocationScenarios(t *testing.T) {
+	bid := "000000000000AE01"
+	owner, spare, stolen, onward := "twitter.com@owner", "reddit.com@spare", "reddit.com@thief", "tumblr.com@thief"
+	leaked, onwardKey, goodKey := newPubKey(), newPubKey(), newPubKey()
+	for _, record := range []*LedgerRecord{
+		{RecType: ClaimBID, BID: bid, PIDs: []string{owner}},
+		{RecType: GrantBID, BID: bid, PIDs: []string{owner, spare}, Key: goodKey},
+		{RecType: GrantBID, BID: bid, PIDs: []string{owner, stolen}, Key: leaked},
+		{RecType: GrantBID, BID: bid, PIDs: []string{stolen, onward}, Key: onwardKey},
+		{RecType: ClaimBID, BID: "ae02", PIDs: []string{"twitter.com@other"}},
+	} {
+		err := appendToLedger(record)
+		if err != nil {
+			t.Fatal("setup: " + err.Error())
+		}
+	}
+
+	revoke := func(pid string, key string) (*LedgerRecord, error) {
+		record := &LedgerRecord{RecType: RevokeKey, BID: bid, PIDs: []string{pid}, PostURLs: []string{"https://example.com/r"}, Key: key}
+		return record, appendToLedger(record)
+	}
+	for _, reject := range []struct {
+		what string
+		pid  string
+		key  string
+	}{
+		{"unmapped revoker", "twitter.com@other", leaked},
+		{"revoker mapped by the key", stolen, leaked},
+		{"revoker mapped by a grant onward from the key", onward, leaked},
+		{"unknown key", owner, newPubKey()},
+	} {
+		_, err := revoke(reject.pid, reject.key)
+		if err == nil {
+			t.Error(reject.what + ": revocation accepted")
+		}
+	}
+	err := appendToLedger(&LedgerRecord{RecType: RevokeKey, BID: "ae02", PIDs: []string{"twitter.com@other"}, Key: leaked})
+	if err == nil {
+		t.Error("revoked a key that granted a different BID")
+	}
+
+	// the leaked key's grant is undone, and so is the grant made onward with what it got
+	record, err := revoke(spare, leaked)
+	if err != nil {
+		t.Fatal("revoke: " + err.Error())
+	}
+	if !reflect.DeepEqual(record.PIDs, []string{spare, stolen, onward}) {
+		t.Errorf("revocation unmapped %v", record.PIDs[1:])
+	}
+	if !reflect.DeepEqual(theStore.pidsForBID(bid), []string{spare, owner}) {
+		t.Errorf("still mapped: %v", theStore.pidsForBID(bid))
+	}
+	if len(theStore.bidsForPID(stolen)) != 0 || len(theStore.bidsForPID(onward)) != 0 {
+		t.Error("thieves still have the BID")
+	}
+
+	// once is enough, and the key still can't be used again
+	_, err = revoke(owner, leaked)
+	if err == nil || !strings.Contains(err.Error(), "already been revoked") {
+		t.Errorf("revoked twice: %v", err)
+	}
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{owner, stolen}, Key: leaked})
+	if err == nil {
+		t.Error("revoked key reused")
+	}
+
+	// revoking a key whose grant has already been undone just marks it
+	_ = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{spare}})
+	record, err = revoke(owner, goodKey)
+	if err != nil || len(record.PIDs) != 1 {
+		t.Errorf("revoking a spent key: %v %v", err, record.PIDs)
+	}
+
+	// the query endpoints show what's been revoked
+	w := httptest.NewRecorder()
+	GetPIDsForBIDHandler(w, httptest.NewRequest("GET", "/pids-for-bid?bid="+bid, nil))
+	var pids getPIDsForBIDResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &pids)
+	wanted := sortedKeys(map[string]bool{leaked: true, goodKey: true})
+	if !reflect.DeepEqual(pids.RevokedKeys, wanted) {
+		t.Error("pids-for-bid doesn't show revoked keys: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	PIDHistoryHandler(w, httptest.NewRequest("GET", "/pid-history?pid="+stolen, nil))
+	var history historyResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &history)
+	if !reflect.DeepEqual(history.RevokedKeys, []string{leaked}) || history.History[len(history.History)-1].RecType != RevokeKey {
+		t.Error("pid-history doesn't show the revocation: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	LedgerHandler(w, httptest.NewRequest("GET", "/ledger?type=Revoke", nil))
+	var page ledgerPage
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Records) != 2 || len(page.RevokedKeys) != 0 {
+		t.Error("wrong Revoke records in ledger: " + w.Body.String())
+	}
+}
+
+func TestRevokeAssertion(t *testing.T) {
+	key := newPubKey()
+	assertion, err := generateRevokeAssertion(0xae03, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fields, err := findBlueskidAssertion(assertion, 6)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bid, revoked, err := checkRevokeAssertion(fields)
+	if err != nil || bid != 0xae03 || revoked != key {
+		t.Errorf("round trip failed: %v", err)
+	}
+
+	swapped := append([]string(nil), fields...)
+	swapped[ClaimCounterparty] = newPubKey()
+	_, _, err = checkRevokeAssertion(swapped)
+	if err == nil {
+		t.Error("accepted a revoke assertion with the key swapped")
+	}
+	grant, _, _ := generateGrantAssertions(0xae03, "twitter.com@a", "twitter.com@b")
+	fields, _ = findBlueskidAssertion(grant, 6)
+	_, _, err = checkRevokeAssertion(fields)
+	if err == nil {
+		t.Error("accepted a grant assertion as a revoke assertion")
+	}
+
+	w := httptest.NewRecorder()
+	RevokeAssertionHandler(w, httptest.NewRequest("POST", "/revoke-assertion", strings.NewReader(`{"BID":"ae03","Key":"`+key+`"}`)))
+	var resp bidAssertionResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	fields, err = findBlueskidAssertion(resp.Assertion, 6)
+	if w.Code != 200 || err != nil || fields[ClaimCounterparty] != key {
+		t.Error("revoke-assertion: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	RevokeAssertionHandler(w, httptest.NewRequest("POST", "/revoke-assertion", strings.NewReader(`{"BID":"ae03","Key":"nope"}`)))
+	if w.Code != 400 {
+		t.Error("revoke-assertion took a bad key")
+	}
+}
+
+func TestRevokeSubmission(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	leaked := newPubKey()
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "ae04", PIDs: []string{"twitter.com@rs1"}})
+	_ = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "ae04", PIDs: []string{"twitter.com@rs1", "reddit.com@rs2"}, Key: leaked})
+	assertion, _ := generateRevokeAssertion(0xae04, leaked)
+	fakePosts["https://example.com/revoke"] = fakePost{"Twitter.com@RS1", "revoking " + assertion}
+
+	s, err := submit(RevokeKey, []string{"https://example.com/revoke"})
+	if err != nil {
+		t.Fatal("submit: " + err.Error())
+	}
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Fatal("revoke not accepted: " + s2.Reason)
+	}
+	if theStore.isMapped("000000000000AE04", "reddit.com@rs2") {
+		t.Error("revoke didn't unmap the grantee")
+	}
+}
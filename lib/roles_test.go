@@ -0,0 +1,226 @@
+package blueskidgo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	defer freshLedger()()
+	roleScenarios(t)
+
+	checkReplay(t, "roles")
+}
+
+func TestRolesSQLite(t *testing.T) {
+	path, restore := freshSQLiteLedger(t)
+	defer restore()
+	roleScenarios(t)
+	reopenSQLiteLedger(t, path)
+}
+
+func roleScenarios(t *testing.T) {
+	bid := "000000000000B001"
+	owner, member, reader := "twitter.com@boss", "reddit.com@staff", "tumblr.com@lurker"
+	roles := func() map[string]string {
+		var r map[string]string
+		theStore.readMappings(func(m *bidMappings) { r = m.Roles[bid] })
+		return r
+	}
+	grant := func(from string, to string, role string) error {
+		return appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{from, to}, Key: newPubKey(), Role: role})
+	}
+	transfer := func(from string, to string) error {
+		return appendToLedger(&LedgerRecord{RecType: TransferBID, BID: bid, PIDs: []string{from, to}, Key: newPubKey()})
+	}
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{owner}})
+	if grant(owner, member, RoleMember) != nil || grant(owner, reader, RoleReadOnly) != nil {
+		t.Fatal("owner can't grant")
+	}
+	if !reflect.DeepEqual(roles(), map[string]string{owner: RoleOwner, member: RoleMember, reader: RoleReadOnly}) {
+		t.Errorf("wrong roles %v", roles())
+	}
+
+	for _, reject := range []struct {
+		what string
+		err  error
+	}{
+		{"grant by member", grant(member, "twitter.com@friend", RoleReadOnly)},
+		{"grant by read-only", grant(reader, "twitter.com@friend", RoleReadOnly)},
+		{"unknown role", grant(owner, "twitter.com@friend", "admin")},
+		{"transfer by member", transfer(member, reader)},
+		{"transfer to self", transfer(owner, owner)},
+		{"role on a claim", appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "b002", PIDs: []string{owner}, Role: RoleMember})},
+		{"revoke by member", appendToLedger(&LedgerRecord{RecType: RevokeKey, BID: bid, PIDs: []string{member}, Key: newPubKey()})},
+	} {
+		if reject.err == nil {
+			t.Error(reject.what + ": accepted")
+		}
+	}
+
+	// grants from before roles made owners
+	err := grant(owner, "reddit.com@legacy", "")
+	if err != nil || roles()["reddit.com@legacy"] != RoleOwner {
+		t.Errorf("grant without a role: %v %v", err, roles())
+	}
+
+	// owners can change roles with another grant
+	err = grant(owner, reader, RoleMember)
+	if err != nil || roles()[reader] != RoleMember {
+		t.Errorf("regrant: %v %v", err, roles())
+	}
+
+	// ownership moves, and the old owner stays on as a member
+	err = transfer(owner, member)
+	if err != nil {
+		t.Fatal("transfer: " + err.Error())
+	}
+	if roles()[owner] != RoleMember || roles()[member] != RoleOwner {
+		t.Errorf("transfer didn't move ownership: %v", roles())
+	}
+	err = grant(owner, "twitter.com@friend", RoleReadOnly)
+	if err == nil || !strings.Contains(err.Error(), "only owners") {
+		t.Errorf("old owner still granting: %v", err)
+	}
+	if grant(member, "twitter.com@friend", RoleReadOnly) != nil {
+		t.Error("new owner can't grant")
+	}
+
+	// a transfer can go to someone who wasn't mapped
+	err = transfer(member, "tumblr.com@heir")
+	if err != nil || roles()["tumblr.com@heir"] != RoleOwner || !theStore.isMapped(bid, "tumblr.com@heir") {
+		t.Errorf("transfer to newcomer: %v %v", err, roles())
+	}
+
+	// anyone can leave
+	err = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{"twitter.com@friend"}})
+	if err != nil {
+		t.Error("read-only can't unclaim: " + err.Error())
+	}
+	if _, ok := roles()["twitter.com@friend"]; ok {
+		t.Error("role outlived the mapping")
+	}
+}
+
+func TestRoleAssertions(t *testing.T) {
+	for _, role := range []string{RoleOwner, RoleMember, RoleReadOnly} {
+		body, _ := json.Marshal(&grantAssertionsRequest{BID: "b003", Granter: "twitter.com@g", Accepter: "reddit.com@a", Role: role})
+		resp, problem, _ := newGrantAssertionsResponse(body)
+		if problem != "" {
+			t.Fatal(role + ": " + problem)
+		}
+		var pair grantAssertionsResponse
+		_ = json.Unmarshal(resp, &pair)
+		gFields, _ := findBlueskidAssertion(pair.GrantAssertion, 6)
+		aFields, _ := findBlueskidAssertion(pair.AcceptAssertion, 6)
+		granter, err := checkPairedAssertions(gFields, "twitter.com@g", aFields, "reddit.com@a")
+		if err != nil || granter.opcode.recType != GrantBID || granter.opcode.role != role {
+			t.Errorf("%s: %v", role, err)
+		}
+	}
+	body, _ := json.Marshal(&grantAssertionsRequest{BID: "b003", Granter: "twitter.com@g", Accepter: "reddit.com@a", Role: "admin"})
+	_, problem, myFault := newGrantAssertionsResponse(body)
+	if problem == "" || myFault {
+		t.Error("made assertions for an unknown role")
+	}
+
+	// the two halves have to agree, and be the right way round
+	g, a, _ := generatePairedAssertions("GM", "AR", 0xb003, "twitter.com@g", "reddit.com@a")
+	gFields, _ := findBlueskidAssertion(g, 6)
+	aFields, _ := findBlueskidAssertion(a, 6)
+	_, err := checkPairedAssertions(gFields, "twitter.com@g", aFields, "reddit.com@a")
+	if err == nil {
+		t.Error("accepted a member grant with a read-only accept")
+	}
+	g, a, _ = generatePairedAssertions("A", "G", 0xb003, "twitter.com@g", "reddit.com@a")
+	gFields, _ = findBlueskidAssertion(g, 6)
+	aFields, _ = findBlueskidAssertion(a, 6)
+	_, err = checkPairedAssertions(gFields, "twitter.com@g", aFields, "reddit.com@a")
+	if err == nil {
+		t.Error("accepted a pair the wrong way round")
+	}
+}
+
+func TestTransferSubmission(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "b004", PIDs: []string{"twitter.com@ts1"}})
+	tr, ac, _ := generatePairedAssertions("T", "TA", 0xb004, "twitter.com@ts1", "reddit.com@ts2")
+	fakePosts["https://example.com/transfer"] = fakePost{"twitter.com@ts1", tr}
+	fakePosts["https://example.com/transfer-accept"] = fakePost{"reddit.com@ts2", ac}
+	g, a, _ := generatePairedAssertions("GM", "AM", 0xb004, "twitter.com@ts1", "reddit.com@ts2")
+	fakePosts["https://example.com/member-grant"] = fakePost{"twitter.com@ts1", g}
+	fakePosts["https://example.com/member-accept"] = fakePost{"reddit.com@ts2", a}
+
+	// transfer assertions don't make a grant, and grant assertions don't make a transfer
+	for _, wrong := range []struct {
+		recType recordType
+		posts   []string
+	}{
+		{GrantBID, []string{"https://example.com/transfer", "https://example.com/transfer-accept"}},
+		{TransferBID, []string{"https://example.com/member-grant", "https://example.com/member-accept"}},
+	} {
+		s, _ := submit(submissionType(wrong.recType), wrong.posts)
+		processSubmission(nextSubmission(t))
+		s2, _ := getSubmission(s.ID)
+		if s2.State != SubmissionRejected {
+			t.Errorf("%s accepted the wrong assertions", recTypeNames[wrong.recType])
+		}
+	}
+
+	s, _ := submit(GrantBID, []string{"https://example.com/member-grant", "https://example.com/member-accept"})
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	records := theStore.recordsSoFar()
+	if s2.State != SubmissionAccepted || records[len(records)-1].Role != RoleMember {
+		t.Error("member grant: " + s2.Reason)
+	}
+	s, _ = submit(TransferBID, []string{"https://example.com/transfer", "https://example.com/transfer-accept"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Fatal("transfer: " + s2.Reason)
+	}
+	var roles map[string]string
+	theStore.readMappings(func(m *bidMappings) { roles = m.Roles["000000000000B004"] })
+	if roles["reddit.com@ts2"] != RoleOwner || roles["twitter.com@ts1"] != RoleMember {
+		t.Errorf("transfer didn't move ownership: %v", roles)
+	}
+}
+
+// TestRolesUpgrade opens a database from before roles, in which everyone mapped is an owner
+func TestRolesUpgrade(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = db.Exec(`
+CREATE TABLE records (sequence INTEGER PRIMARY KEY, rec_type INTEGER NOT NULL, bid TEXT NOT NULL, pids TEXT NOT NULL,
+	post_urls TEXT NOT NULL, key TEXT NOT NULL, at TEXT NOT NULL);
+CREATE TABLE pid_bid (bid TEXT NOT NULL, pid TEXT NOT NULL, PRIMARY KEY (bid, pid));
+INSERT INTO records VALUES (0, 0, '000000000000B005', '["twitter.com@old"]', '[]', '', '2021-09-20T17:42:05Z');
+INSERT INTO pid_bid VALUES ('000000000000B005', 'twitter.com@old');`)
+	_ = db.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	saved := theStore
+	defer func() { theStore = saved }()
+	theStore, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal("open: " + err.Error())
+	}
+	defer func() { _ = theStore.db.close() }()
+	err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: "b005", PIDs: []string{"twitter.com@old", "reddit.com@new"}, Key: newPubKey(), Role: RoleMember})
+	if err != nil {
+		t.Error("owner from before roles can't grant: " + err.Error())
+	}
+}
@@ -0,0 +1,328 @@
+package blueskidgo
+
+// Keeps the ledger in SQLite, so it survives restarts. The records table is the ledger; pid_bid and the key tables are
+//  the indexes the append rules consult, and are updated in the same transaction as the record is inserted, so
+//  the file is always consistent. Queries are still answered from memory: the store replays the records table,
+//  recomputing the hashes, when the database is opened, and from then on every append goes to the database first
+//  and to memory only if the database commits.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go, no cgo
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	sequence  INTEGER PRIMARY KEY,
+	rec_type  INTEGER NOT NULL,
+	bid       TEXT NOT NULL,
+	pids      TEXT NOT NULL,
+	post_urls TEXT NOT NULL,
+	key       TEXT NOT NULL,
+	at        TEXT NOT NULL,
+	submitter TEXT NOT NULL DEFAULT '',
+	role      TEXT NOT NULL DEFAULT '',
+	threshold INTEGER NOT NULL DEFAULT 0,
+	approvals TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS records_bid ON records (bid);
+CREATE TABLE IF NOT EXISTS pid_bid (
+	bid  TEXT NOT NULL,
+	pid  TEXT NOT NULL,
+	role TEXT NOT NULL DEFAULT 'owner',
+	PRIMARY KEY (bid, pid)
+);
+CREATE INDEX IF NOT EXISTS pid_bid_pid ON pid_bid (pid);
+CREATE TABLE IF NOT EXISTS used_keys (
+	key      TEXT PRIMARY KEY,
+	sequence INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS revoked_keys (
+	key      TEXT PRIMARY KEY,
+	sequence INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bid_policy (
+	bid       TEXT PRIMARY KEY,
+	threshold INTEGER NOT NULL
+);
+`
+
+type sqliteLedger struct {
+	db *sql.DB
+}
+
+// OpenLedgerDB switches the server to a ledger kept in the SQLite database at path, creating it if need be, and
+// loads what's already there. Call it before starting anything that uses the ledger.
+func OpenLedgerDB(path string) error {
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		return err
+	}
+	theStore = serverStore(s)
+	return nil
+}
+
+func openSQLiteStore(path string) (*ledgerStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// one connection, so that the store lock is the only lock there is
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.New("can't set up ledger database: " + err.Error())
+	}
+	// databases from before records had submitters, from before roles, when everyone was an owner, and from
+	// before policies
+	for _, upgrade := range []struct{ table, column, definition string }{
+		{"records", "submitter", `TEXT NOT NULL DEFAULT ''`},
+		{"records", "role", `TEXT NOT NULL DEFAULT ''`},
+		{"pid_bid", "role", `TEXT NOT NULL DEFAULT 'owner'`},
+		{"records", "threshold", `INTEGER NOT NULL DEFAULT 0`},
+		{"records", "approvals", `TEXT NOT NULL DEFAULT ''`},
+	} {
+		_, err = db.Exec(`SELECT ` + upgrade.column + ` FROM ` + upgrade.table + ` LIMIT 0`)
+		if err != nil {
+			_, err = db.Exec(`ALTER TABLE ` + upgrade.table + ` ADD COLUMN ` + upgrade.column + ` ` + upgrade.definition)
+			if err != nil {
+				_ = db.Close()
+				return nil, errors.New("can't upgrade ledger database: " + err.Error())
+			}
+		}
+	}
+
+	s := newLedgerStore()
+	s.db = &sqliteLedger{db: db}
+	err = s.db.load(s)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the records table into a new, empty store
+func (l *sqliteLedger) load(s *ledgerStore) error {
+	rows, err := l.db.Query(`SELECT sequence, rec_type, bid, pids, post_urls, key, at, submitter, role, threshold, approvals FROM records ORDER BY sequence`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var record LedgerRecord
+		var pids, postURLs, at, submitter, approvals string
+		err = rows.Scan(&record.Sequence, &record.RecType, &record.BID, &pids, &postURLs, &record.Key, &at, &submitter, &record.Role,
+			&record.Threshold, &approvals)
+		if err == nil {
+			err = json.Unmarshal([]byte(pids), &record.PIDs)
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(postURLs), &record.PostURLs)
+		}
+		if err == nil {
+			record.When, err = time.Parse(time.RFC3339Nano, at)
+		}
+		if err == nil && submitter != "" {
+			err = json.Unmarshal([]byte(submitter), &record.Submitter)
+		}
+		if err == nil && approvals != "" {
+			err = json.Unmarshal([]byte(approvals), &record.Approvals)
+		}
+		if err != nil {
+			return errors.New("corrupt ledger database: " + err.Error())
+		}
+		if record.Sequence != len(s.records) {
+			return errors.New("corrupt ledger database: record " + strconv.Itoa(len(s.records)) + " is missing")
+		}
+		previous := ""
+		if len(s.records) > 0 {
+			previous = s.records[len(s.records)-1].Hash
+		}
+		record.Hash = recordHash(previous, &record)
+		if usesKey(&record) {
+			s.keysUsed[record.Key] = true
+		}
+		s.mappings.apply(&record)
+		s.records = append(s.records, &record)
+	}
+	return rows.Err()
+}
+
+// append validates the record against the tables and writes it, all in one transaction
+func (l *sqliteLedger) append(txn *ledgerTxn) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = txn.validate(sqliteIndexes{tx})
+	if err == nil {
+		err = l.write(tx, &txn.next)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (l *sqliteLedger) write(tx *sql.Tx, record *LedgerRecord) error {
+	pids, err := json.Marshal(record.PIDs)
+	if err != nil {
+		return err
+	}
+	postURLs, err := json.Marshal(record.PostURLs)
+	if err != nil {
+		return err
+	}
+	submitter := ""
+	if record.Submitter != nil {
+		b, err := json.Marshal(record.Submitter)
+		if err != nil {
+			return err
+		}
+		submitter = string(b)
+	}
+	approvals := ""
+	if len(record.Approvals) > 0 {
+		b, err := json.Marshal(record.Approvals)
+		if err != nil {
+			return err
+		}
+		approvals = string(b)
+	}
+	_, err = tx.Exec(`INSERT INTO records (sequence, rec_type, bid, pids, post_urls, key, at, submitter, role, threshold, approvals)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Sequence, int(record.RecType), record.BID, string(pids), string(postURLs), record.Key,
+		record.When.Format(time.RFC3339Nano), submitter, record.Role, record.Threshold, approvals)
+	if err != nil {
+		return err
+	}
+
+	// same effect as bidMappings.apply
+	switch record.RecType {
+	case ClaimBID:
+		_, err = tx.Exec(`DELETE FROM bid_policy WHERE bid = ?`, record.BID)
+		if err == nil {
+			err = setRole(tx, record.BID, record.PIDs[0], RoleOwner)
+		}
+	case GrantBID:
+		err = setRole(tx, record.BID, record.PIDs[1], grantedRole(record))
+	case TransferBID:
+		err = setRole(tx, record.BID, record.PIDs[0], RoleMember)
+		if err == nil {
+			err = setRole(tx, record.BID, record.PIDs[1], RoleOwner)
+		}
+	case UnclaimBID:
+		_, err = tx.Exec(`DELETE FROM pid_bid WHERE bid = ? AND pid = ?`, record.BID, record.PIDs[0])
+	case RemovePID:
+		_, err = tx.Exec(`DELETE FROM pid_bid WHERE bid = ? AND pid = ?`, record.BID, record.PIDs[1])
+	case RevokeKey:
+		for _, pid := range record.PIDs[1:] {
+			if err == nil {
+				_, err = tx.Exec(`DELETE FROM pid_bid WHERE bid = ? AND pid = ?`, record.BID, pid)
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO revoked_keys (key, sequence) VALUES (?, ?)`, record.Key, record.Sequence)
+		}
+	case PolicyBID:
+		if record.Threshold > 1 {
+			_, err = tx.Exec(`INSERT INTO bid_policy (bid, threshold) VALUES (?, ?) ON CONFLICT (bid) DO UPDATE SET threshold = excluded.threshold`,
+				record.BID, record.Threshold)
+		} else {
+			_, err = tx.Exec(`DELETE FROM bid_policy WHERE bid = ?`, record.BID)
+		}
+	}
+	if err == nil && usesKey(record) {
+		_, err = tx.Exec(`INSERT INTO used_keys (key, sequence) VALUES (?, ?)`, record.Key, record.Sequence)
+	}
+	return err
+}
+
+// setRole maps pid to bid with role, or if it's mapped already, changes its role
+func setRole(tx *sql.Tx, bid string, pid string, role string) error {
+	_, err := tx.Exec(`INSERT INTO pid_bid (bid, pid, role) VALUES (?, ?, ?) ON CONFLICT (bid, pid) DO UPDATE SET role = excluded.role`,
+		bid, pid, role)
+	return err
+}
+
+func (l *sqliteLedger) close() error {
+	return l.db.Close()
+}
+
+// sqliteIndexes answers validation's questions from inside the transaction
+type sqliteIndexes struct {
+	tx *sql.Tx
+}
+
+func (x sqliteIndexes) exists(query string, args ...interface{}) (bool, error) {
+	var found int
+	err := x.tx.QueryRow(`SELECT EXISTS (`+query+`)`, args...).Scan(&found)
+	return found != 0, err
+}
+
+func (x sqliteIndexes) bidExists(bid string) (bool, error) {
+	return x.exists(`SELECT 1 FROM records WHERE bid = ? AND rec_type = ?`, bid, ClaimBID)
+}
+
+func (x sqliteIndexes) isMappedTo(bid string, pid string) (bool, error) {
+	return x.exists(`SELECT 1 FROM pid_bid WHERE bid = ? AND pid = ?`, bid, pid)
+}
+
+func (x sqliteIndexes) roleOf(bid string, pid string) (string, error) {
+	var role string
+	err := x.tx.QueryRow(`SELECT role FROM pid_bid WHERE bid = ? AND pid = ?`, bid, pid).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (x sqliteIndexes) owners(bid string) (int, error) {
+	var count int
+	err := x.tx.QueryRow(`SELECT COUNT(*) FROM pid_bid WHERE bid = ? AND role = ?`, bid, RoleOwner).Scan(&count)
+	return count, err
+}
+
+func (x sqliteIndexes) threshold(bid string) (int, error) {
+	var threshold int
+	err := x.tx.QueryRow(`SELECT threshold FROM bid_policy WHERE bid = ?`, bid).Scan(&threshold)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return threshold, err
+}
+
+// tombstoned is true, with when the last PID left, for a claimed BID that has no PIDs
+func (x sqliteIndexes) tombstoned(bid string) (time.Time, bool, error) {
+	active, err := x.exists(`SELECT 1 FROM pid_bid WHERE bid = ?`, bid)
+	if err != nil || active {
+		return time.Time{}, false, err
+	}
+	var at string
+	err = x.tx.QueryRow(`SELECT at FROM records WHERE bid = ? ORDER BY sequence DESC LIMIT 1`, bid).Scan(&at)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	since, err := time.Parse(time.RFC3339Nano, at)
+	return since, err == nil, err
+}
+
+func (x sqliteIndexes) keyUsed(key string) (bool, error) {
+	return x.exists(`SELECT 1 FROM used_keys WHERE key = ?`, key)
+}
+
+func (x sqliteIndexes) keyRevoked(key string) (bool, error) {
+	return x.exists(`SELECT 1 FROM revoked_keys WHERE key = ?`, key)
+}
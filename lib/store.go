@@ -0,0 +1,116 @@
+package blueskidgo
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ledgerStore holds the ledger and the tables derived from it. Appends take the write lock; everything else takes
+// the read lock. Records are never changed once appended and the records slice is only ever appended to, so a copy
+// of the slice taken with the lock held can be read without it.
+type ledgerStore struct {
+	lock sync.RWMutex
+
+	records []*LedgerRecord
+
+	// the BID/PID mappings as of the latest record
+	mappings *bidMappings
+
+	// keysUsed tracks the public keys that have appeared in assertions, so as to prevent re-use.
+	keysUsed map[string]bool
+
+	// reservations is indexed by BID
+	reservations map[string]reservation
+
+	// appendSignal is closed and replaced after every append. Anyone who wants to wait for the next append grabs
+	// it with the lock held and then waits for it to close.
+	appendSignal chan struct{}
+
+	// db, if there is one, is where the ledger is kept; the rest of this is loaded from it at startup
+	db *sqliteLedger
+
+	// cluster, if there is one, is where appends go; they come back via the Raft log, see cluster.go
+	cluster *Cluster
+
+	// snapshots[n] is the mappings after the first n records, for n a multiple of snapshotEvery, see as_of.go
+	snapshotsLock sync.Mutex
+	snapshots     map[int]*bidMappings
+	snapshotEvery int
+
+	// announce is set on the store this server takes appends for, so that the appends it accepts, and only those,
+	// go to the webhooks; see stream.go. Scratch stores, and records that were accepted somewhere else and are only
+	// being replayed here, don't announce anything.
+	announce bool
+}
+
+func newLedgerStore() *ledgerStore {
+	return &ledgerStore{
+		records:      make([]*LedgerRecord, 0),
+		mappings:     newBIDMappings(),
+		keysUsed:     make(map[string]bool),
+		reservations: make(map[string]reservation),
+		appendSignal: make(chan struct{}),
+	}
+}
+
+var theStore = serverStore(newLedgerStore())
+
+// serverStore marks s as the store this server takes appends for
+func serverStore(s *ledgerStore) *ledgerStore {
+	s.announce = true
+	return s
+}
+
+type storeKey struct{}
+
+// storeFor returns the store that a request should be answered from. That's theStore, unless the request came in
+// through a Replica's serve, which answers from the replica's own store.
+func storeFor(httpRequest *http.Request) *ledgerStore {
+	s, ok := httpRequest.Context().Value(storeKey{}).(*ledgerStore)
+	if ok {
+		return s
+	}
+	return theStore
+}
+
+// recordsSoFar returns the ledger as it is right now; later appends won't show up in it
+func (s *ledgerStore) recordsSoFar() []*LedgerRecord {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.records
+}
+
+// nextAppend returns the records from 'from' on, and a channel that will be closed at the next append after that
+func (s *ledgerStore) nextAppend(from int) ([]*LedgerRecord, <-chan struct{}) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if from >= len(s.records) {
+		return nil, s.appendSignal
+	}
+	return s.records[from:], s.appendSignal
+}
+
+// readMappings calls fn with the current mappings, which it must not modify or hang on to
+func (s *ledgerStore) readMappings(fn func(m *bidMappings)) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	fn(s.mappings)
+}
+
+func (s *ledgerStore) isMapped(bid string, pid string) bool {
+	mapped := false
+	s.readMappings(func(m *bidMappings) { mapped = m.PIDsForBID[bid][pid] })
+	return mapped
+}
+
+func (s *ledgerStore) pidsForBID(bid string) []string {
+	var pids []string
+	s.readMappings(func(m *bidMappings) { pids = sortedKeys(m.PIDsForBID[bid]) })
+	return pids
+}
+
+func (s *ledgerStore) bidsForPID(pid string) []string {
+	var bids []string
+	s.readMappings(func(m *bidMappings) { bids = sortedKeys(m.BIDsForPID[pid]) })
+	return bids
+}
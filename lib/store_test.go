@@ -0,0 +1,112 @@
+package blueskidgo
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// run with -race; most of what this is checking for is what the race detector complains about
+func TestStoreConcurrency(t *testing.T) {
+	defer freshLedger()()
+	rememberInterval := SnapshotInterval
+	SnapshotInterval = 7
+	defer func() { SnapshotInterval = rememberInterval }()
+
+	writers := 8
+	rounds := 25
+	pid := func(w int) string { return "twitter.com@store" + strconv.Itoa(w) }
+
+	var writing sync.WaitGroup
+	errs := make(chan error, writers*rounds*3)
+	for w := 0; w < writers; w++ {
+		writing.Add(1)
+		go func(w int) {
+			defer writing.Done()
+			for r := 0; r < rounds; r++ {
+				bid := fmt.Sprintf("%04x%04x", w+1, r)
+				err := appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: bid, PIDs: []string{pid(w)}})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				other := pid((w + 1) % writers)
+				err = appendToLedger(&LedgerRecord{RecType: GrantBID, BID: bid, PIDs: []string{pid(w), other}, Key: newPubKey()})
+				if err != nil {
+					errs <- err
+				}
+				if r%3 == 0 {
+					err = appendToLedger(&LedgerRecord{RecType: UnclaimBID, BID: bid, PIDs: []string{pid(w)}})
+					if err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+
+	queries := []struct {
+		handler http.HandlerFunc
+		url     string
+	}{
+		{GetPIDGroupHandler, "/pid-group?pid=" + pid(0)},
+		{GetPIDsForBIDHandler, "/pids-for-bid?bid=00010000"},
+		{GetBIDsforPIDHandler, "/bids-for-pid?pid=" + pid(1)},
+		{GetBIDsforPIDHandler, "/bids-for-pid?pid=" + pid(1) + "&asOf=40"},
+		{PIDGraphHandler, "/pid-graph?pid=" + pid(2)},
+		{PIDGraphHandler, "/pid-graph?pid=" + pid(2) + "&asOf=100"},
+		{LedgerHandler, "/ledger?limit=50"},
+		{BIDHistoryHandler, "/bid-history?bid=00020001"},
+		{PIDHistoryHandler, "/pid-history?pid=" + pid(3)},
+	}
+	done := make(chan struct{})
+	var reading sync.WaitGroup
+	for _, q := range queries {
+		reading.Add(1)
+		go func(handler http.HandlerFunc, url string) {
+			defer reading.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest("GET", url, nil))
+				if w.Code != 200 {
+					errs <- fmt.Errorf("%s: %d %s", url, w.Code, w.Body.String())
+					return
+				}
+			}
+		}(q.handler, q.url)
+	}
+
+	writing.Wait()
+	close(done)
+	reading.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err.Error())
+	}
+
+	records := theStore.recordsSoFar()
+	wanted := writers*rounds*2 + writers*((rounds+2)/3)
+	if len(records) != wanted {
+		t.Errorf("%d records, wanted %d", len(records), wanted)
+	}
+	for i, record := range records {
+		if record.Sequence != i {
+			t.Fatalf("record %d has sequence %d", i, record.Sequence)
+		}
+	}
+	replayed := theStore.mappingsAfter(records, len(records))
+	theStore.readMappings(func(m *bidMappings) {
+		if !reflect.DeepEqual(m, replayed) {
+			t.Error("live mappings don't match replay of the ledger")
+		}
+	})
+}
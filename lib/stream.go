@@ -0,0 +1,194 @@
+package blueskidgo
+
+// Lets other services find out about ledger appends as they happen, rather than polling /ledger. There are two
+//  ways: a Server-Sent Events stream at /ledger/stream, and webhooks that get POSTed each new record. In both cases
+//  each record is identified by its sequence number, which is just its position in the ledger.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LedgerEvent struct {
+	Sequence int
+	Record   *LedgerRecord
+}
+
+// StreamKeepalive is how often an idle SSE stream gets a comment line, to stop proxies from timing it out
+var StreamKeepalive = 30 * time.Second
+
+// announceAppend is called, with the store's lock held, after every append that this server's store accepts; in a
+// cluster, that's the appends that went through this server while it was leader
+func announceAppend(record *LedgerRecord) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for _, hook := range webhooks {
+		hook.offer(LedgerEvent{Sequence: record.Sequence, Record: record})
+	}
+}
+
+// LedgerStreamHandler serves /ledger/stream. Clients can resume with ?from=<sequence> or, as SSE clients do
+// automatically on reconnecting, with a Last-Event-ID header.
+func LedgerStreamHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	from := 0
+	var err error
+	if s := httpRequest.Form.Get("from"); s != "" {
+		from, err = strconv.Atoi(s)
+		if err != nil || from < 0 {
+			http.Error(w, "parameter 'from' must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	} else if s := httpRequest.Header.Get("Last-Event-ID"); s != "" {
+		from, err = strconv.Atoi(s)
+		if err != nil || from < 0 {
+			http.Error(w, "Last-Event-ID must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		from++
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(StreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		records, signal := storeFor(httpRequest).nextAppend(from)
+
+		for _, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: append\ndata: %s\n\n", from, data)
+			if err != nil {
+				return
+			}
+			from++
+		}
+		flusher.Flush()
+
+		select {
+		case <-signal:
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case <-httpRequest.Context().Done():
+			return
+		}
+	}
+}
+
+// WebhookSignatureHeader carries "sha256=" followed by the hex HMAC-SHA256, keyed with the webhook's secret, of
+// the request body.
+const WebhookSignatureHeader = "X-Blueskid-Signature"
+
+// WebhookAttempts is how many times delivery of an event is tried before giving up on it
+var WebhookAttempts = 5
+
+// WebhookBackoff is the base for exponential backoff between attempts
+var WebhookBackoff = time.Second
+
+type webhook struct {
+	url    string
+	secret []byte
+	events chan LedgerEvent
+	client *http.Client
+}
+
+var webhooks []*webhook
+var webhooksLock sync.Mutex
+
+// AddWebhook arranges for every ledger append to be POSTed to url. Events are delivered in order, one at a time.
+func AddWebhook(url string, secret string) {
+	hook := &webhook{
+		url:    url,
+		secret: []byte(secret),
+		events: make(chan LedgerEvent, 1000),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	webhooksLock.Lock()
+	webhooks = append(webhooks, hook)
+	webhooksLock.Unlock()
+	go hook.deliver()
+}
+
+// offer can't block, because the caller holds the store's lock
+func (hook *webhook) offer(event LedgerEvent) {
+	select {
+	case hook.events <- event:
+	default:
+		log.Printf("webhook %s: queue full, dropped event %d", hook.url, event.Sequence)
+	}
+}
+
+func (hook *webhook) deliver() {
+	for event := range hook.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("webhook %s: can't marshal event %d: %s", hook.url, event.Sequence, err.Error())
+			continue
+		}
+		for attempt := 0; attempt < WebhookAttempts; attempt++ {
+			if attempt > 0 {
+				// full jitter
+				backoff := WebhookBackoff << uint(attempt-1)
+				time.Sleep(time.Duration(rand.Int63n(int64(backoff)) + 1))
+			}
+			err = hook.post(body)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("webhook %s: giving up on event %d: %s", hook.url, event.Sequence, err.Error())
+		}
+	}
+}
+
+func (hook *webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, "sha256="+signWebhookBody(hook.secret, body))
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func signWebhookBody(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,148 @@
+package blueskidgo
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent returns the id and data lines of the next SSE event
+func readEvent(t *testing.T, lines *bufio.Scanner) (id string, data string) {
+	for lines.Scan() {
+		line := lines.Text()
+		switch {
+		case line == "":
+			if id != "" {
+				return
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		}
+	}
+	t.Error("stream ended")
+	return
+}
+
+func TestLedgerStream(t *testing.T) {
+	defer freshLedger()()
+	server := httptest.NewServer(http.HandlerFunc(LedgerStreamHandler))
+	defer server.Close()
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "5e0", PIDs: []string{"twitter.com@stream0"}})
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "5e1", PIDs: []string{"twitter.com@stream1"}})
+
+	resp, err := http.Get(server.URL + "?from=1")
+	if err != nil {
+		t.Fatal("GET: " + err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.Header.Get("Content-type") != "text/event-stream" {
+		t.Error("wrong content type")
+	}
+	lines := bufio.NewScanner(resp.Body)
+
+	// backlog
+	id, data := readEvent(t, lines)
+	if id != "1" || !strings.Contains(data, "twitter.com@stream1") {
+		t.Error("wrong backlog event: " + id + " " + data)
+	}
+
+	// live
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "5e2", PIDs: []string{"twitter.com@stream2"}})
+	id, data = readEvent(t, lines)
+	if id != "2" {
+		t.Error("wrong live event id: " + id)
+	}
+	var record LedgerRecord
+	err = json.Unmarshal([]byte(data), &record)
+	if err != nil || record.PIDs[0] != "twitter.com@stream2" {
+		t.Error("wrong live event: " + data)
+	}
+
+	// resume from Last-Event-ID
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("GET: " + err.Error())
+	}
+	defer func() { _ = resp2.Body.Close() }()
+	id, _ = readEvent(t, bufio.NewScanner(resp2.Body))
+	if id != "2" {
+		t.Error("Last-Event-ID resume started at " + id)
+	}
+
+	resp3, _ := http.Get(server.URL + "?from=minus-one")
+	if resp3.StatusCode != 400 {
+		t.Error("accepted bad 'from'")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	defer freshLedger()()
+	secret := "hush"
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	deliveries := make(chan delivery, 10)
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{body, r.Header.Get(WebhookSignatureHeader)}
+	}))
+	defer receiver.Close()
+
+	rememberBackoff := WebhookBackoff
+	WebhookBackoff = time.Millisecond
+	defer func() { WebhookBackoff = rememberBackoff }()
+	rememberHooks := webhooks
+	defer func() { webhooks = rememberHooks }()
+	AddWebhook(receiver.URL, secret)
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: "77e", PIDs: []string{"twitter.com@hooked"}})
+
+	select {
+	case d := <-deliveries:
+		if d.signature != "sha256="+signWebhookBody([]byte(secret), d.body) {
+			t.Error("bad signature: " + d.signature)
+		}
+		var event LedgerEvent
+		err := json.Unmarshal(d.body, &event)
+		if err != nil {
+			t.Error("bad body: " + err.Error())
+		}
+		if event.Sequence != 0 || event.Record.PIDs[0] != "twitter.com@hooked" {
+			t.Error("wrong event: " + string(d.body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("webhook not delivered")
+	}
+}
+
+// queueingWebhook adds a webhook that never delivers anything, so that what it's offered can be counted with
+// len(hook.events). Call the returned func to take it away again.
+func queueingWebhook() (*webhook, func()) {
+	hook := &webhook{url: "queue", events: make(chan LedgerEvent, 1000)}
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	saved := webhooks
+	webhooks = append(append([]*webhook(nil), saved...), hook)
+	return hook, func() {
+		webhooksLock.Lock()
+		webhooks = saved
+		webhooksLock.Unlock()
+	}
+}
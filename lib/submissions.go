@@ -0,0 +1,319 @@
+package blueskidgo
+
+// Claim, Grant, Unclaim, and other requests are queued as submissions. Fetching posts from social-media providers is
+//  slow and flaky, so it happens in background workers, and clients poll /submissions/{id} to see how things turned
+//  out.
+//  If a journal file is provided, every change in a submission's state is appended to it, so that pending
+//  submissions survive a restart.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SubmissionPending  = "pending"
+	SubmissionAccepted = "accepted"
+	SubmissionRejected = "rejected"
+)
+
+// MaxFetchAttempts is how many times a worker tries to fetch a submission's posts, or to get an unavailable
+// cluster to take the record, before giving up
+var MaxFetchAttempts = 5
+
+// RetryDelay is multiplied by the number of attempts so far to get the wait before the next one
+var RetryDelay = 30 * time.Second
+
+// submissionType is the type of record a submission is for, or ApproveChange
+type submissionType recordType
+
+// ApproveChange is the type of submissions that approve a change that's waiting for approvals, see approvals.go.
+// It's not a record type, and is never in the ledger.
+const ApproveChange submissionType = -1
+
+func (t submissionType) MarshalJSON() ([]byte, error) {
+	if t == ApproveChange {
+		return json.Marshal("Approval")
+	}
+	return recordType(t).MarshalJSON()
+}
+
+func (t *submissionType) UnmarshalJSON(b []byte) error {
+	var name string
+	if json.Unmarshal(b, &name) == nil && name == "Approval" {
+		*t = ApproveChange
+		return nil
+	}
+	return (*recordType)(t).UnmarshalJSON(b)
+}
+
+type Submission struct {
+	ID        string
+	RecType   submissionType
+	Posts     []string
+	State     string
+	Reason    string `json:",omitempty"`
+	Attempts  int
+	Submitted time.Time
+	Updated   time.Time
+	Approvals []Approval `json:",omitempty"` // for a change waiting for approvals, the ones it has so far
+}
+
+var submissions = make(map[string]*Submission)
+var submissionsLock sync.Mutex
+var submissionQueue = make(chan string, 10000)
+var submissionJournal *os.File
+
+// OpenSubmissionJournal replays the journal at path, if there is one, re-queues anything that was still pending,
+// and arranges for subsequent changes to be appended.
+func OpenSubmissionJournal(path string) error {
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	// last line for any ID wins
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lines.Scan() {
+		var s Submission
+		err = json.Unmarshal(lines.Bytes(), &s)
+		if err != nil {
+			_ = f.Close()
+			return errors.New("corrupt submission journal: " + err.Error())
+		}
+		submissions[s.ID] = &s
+	}
+	if lines.Err() != nil {
+		_ = f.Close()
+		return lines.Err()
+	}
+	for id, s := range submissions {
+		if s.State == SubmissionPending {
+			err = enqueue(id)
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+		}
+	}
+	submissionJournal = f
+	return nil
+}
+
+// StartVerifiers launches the background workers that process submissions
+func StartVerifiers(count int) {
+	for i := 0; i < count; i++ {
+		go func() {
+			for id := range submissionQueue {
+				processSubmission(id)
+			}
+		}()
+	}
+}
+
+func submit(recType submissionType, posts []string) (*Submission, error) {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	s := &Submission{
+		ID:        hex.EncodeToString(idBytes),
+		RecType:   recType,
+		Posts:     posts,
+		State:     SubmissionPending,
+		Submitted: now,
+		Updated:   now,
+	}
+
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+	err = journal(s)
+	if err != nil {
+		return nil, err
+	}
+	err = enqueue(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	submissions[s.ID] = s
+	c := *s
+	return &c, nil
+}
+
+func submitAndRespond(w http.ResponseWriter, recType submissionType, posts []string) {
+	s, err := submit(recType, posts)
+	if err != nil {
+		http.Error(w, "Can't queue submission: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	respJSON, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		http.Error(w, "response creation failure: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Location", "/submissions/"+s.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(respJSON)
+}
+
+// processSubmission does the fetching and checking and, if all is well, the ledger append
+func processSubmission(id string) {
+	submissionsLock.Lock()
+	s, ok := submissions[id]
+	if !ok || s.State != SubmissionPending {
+		submissionsLock.Unlock()
+		return
+	}
+	recType := s.RecType
+	posts := s.Posts
+	approvals := append([]Approval(nil), s.Approvals...)
+	submitter := &Submitter{Via: SubmittedViaAPI, Submission: s.ID, Submitted: s.Submitted}
+	submissionsLock.Unlock()
+
+	record, retryable, err := recordFromPosts(recType, posts)
+	parked := ""
+	if err == nil && recType == ApproveChange {
+		retryable, err = approveChange(record)
+	} else if err == nil {
+		// a change that was waiting for approvals before a restart picks up the ones it had
+		record.Approvals = approvals
+		record.Submitter = submitter
+		err = appendToLedger(record)
+		_, retryable = err.(*ClusterUnavailableError)
+		if needed, ok := err.(*ApprovalsNeededError); ok {
+			parked, err = parkChange(record, id, submitter.Submitted, needed)
+		}
+	}
+
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+	s.Attempts++
+	s.Updated = time.Now().UTC()
+	if parked != "" {
+		// settleSubmission finishes it
+		s.Reason = parked
+	} else if err == nil {
+		s.State = SubmissionAccepted
+		s.Reason = ""
+	} else {
+		s.Reason = err.Error()
+		if retryable && s.Attempts < MaxFetchAttempts {
+			delay := RetryDelay * time.Duration(s.Attempts)
+			var throttled *UpstreamThrottledError
+			if errors.As(err, &throttled) && throttled.RetryAfter > delay {
+				delay = throttled.RetryAfter
+			}
+			time.AfterFunc(delay, func() {
+				submissionsLock.Lock()
+				defer submissionsLock.Unlock()
+				if enqueue(id) != nil {
+					s.State = SubmissionRejected
+					s.Reason = "queue full on retry after: " + s.Reason
+					_ = journal(s)
+				}
+			})
+		} else {
+			s.State = SubmissionRejected
+		}
+	}
+	_ = journal(s)
+}
+
+// journalApprovals records the approvals a pending submission's change has so far, so that they survive a restart
+func journalApprovals(id string, approvals []Approval) {
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+	s, ok := submissions[id]
+	if !ok || s.State != SubmissionPending {
+		return
+	}
+	s.Approvals = approvals
+	s.Updated = time.Now().UTC()
+	_ = journal(s)
+}
+
+// settleSubmission accepts a pending submission, or if err isn't nil, rejects it
+func settleSubmission(id string, err error) {
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+	s, ok := submissions[id]
+	if !ok || s.State != SubmissionPending {
+		return
+	}
+	s.Updated = time.Now().UTC()
+	if err == nil {
+		s.State = SubmissionAccepted
+		s.Reason = ""
+	} else {
+		s.State = SubmissionRejected
+		s.Reason = err.Error()
+	}
+	_ = journal(s)
+}
+
+// enqueue doesn't block; if the workers are that far behind, better to tell the client
+func enqueue(id string) error {
+	select {
+	case submissionQueue <- id:
+		return nil
+	default:
+		return errors.New("submission queue is full")
+	}
+}
+
+// journal must be called with submissionsLock held
+func journal(s *Submission) error {
+	if submissionJournal == nil {
+		return nil
+	}
+	line, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = submissionJournal.Write(append(line, '\n'))
+	return err
+}
+
+func getSubmission(id string) (Submission, bool) {
+	submissionsLock.Lock()
+	defer submissionsLock.Unlock()
+	s, ok := submissions[id]
+	if !ok {
+		return Submission{}, false
+	}
+	return *s, true
+}
+
+// SubmissionHandler serves /submissions/{id}
+func SubmissionHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	if !openGet(w, httpRequest) {
+		return
+	}
+	id := strings.TrimPrefix(httpRequest.URL.Path, "/submissions/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "missing or malformed submission ID", http.StatusBadRequest)
+		return
+	}
+	s, ok := getSubmission(id)
+	if !ok {
+		http.Error(w, "no such submission: "+id, http.StatusNotFound)
+		return
+	}
+	respJSON, err := json.MarshalIndent(s, "", " ")
+	writeJson(w, respJSON, err)
+}
@@ -0,0 +1,197 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stand-ins for social-media posts, so these tests don't go out to the network
+
+type fakePost struct {
+	pid  string
+	text string
+}
+
+var fakePosts = make(map[string]fakePost)
+
+func fakeFetch(url string, fieldCount int) ([]string, string, error) {
+	post, ok := fakePosts[url]
+	if !ok {
+		return nil, "", &PostGoneError{URL: url, Status: 404}
+	}
+	fields, err := findBlueskidAssertion(post.text, fieldCount)
+	return fields, post.pid, err
+}
+
+func nextSubmission(t *testing.T) string {
+	select {
+	case id := <-submissionQueue:
+		return id
+	case <-time.After(2 * time.Second):
+		t.Error("nothing in submission queue")
+		return ""
+	}
+}
+
+func TestSubmissions(t *testing.T) {
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	bid := uint64(0x5ab5ab)
+	fakePosts["https://example.com/sub-claim"] = fakePost{"twitter.com@sub1", "claiming " + bidAssertion("C", bid)}
+	fakePosts["https://example.com/sub-unclaim"] = fakePost{"twitter.com@sub3", bidAssertion("U", bid)}
+	g, a, _ := generateGrantAssertions(bid, "twitter.com@sub1", "reddit.com@sub2")
+	fakePosts["https://example.com/sub-grant"] = fakePost{"twitter.com@sub1", g}
+	fakePosts["https://example.com/sub-accept"] = fakePost{"reddit.com@sub2", a}
+
+	// claim
+	s, err := submit(ClaimBID, []string{"https://example.com/sub-claim"})
+	if err != nil {
+		t.Error("submit: " + err.Error())
+	}
+	if s.State != SubmissionPending {
+		t.Error("new submission not pending")
+	}
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Error("claim not accepted: " + s2.Reason)
+	}
+	if !theStore.isMapped(FormatBID(bid), "twitter.com@sub1") {
+		t.Error("claim didn't reach ledger")
+	}
+	records := theStore.recordsSoFar()
+	submitter := records[len(records)-1].Submitter
+	if submitter == nil || submitter.Via != SubmittedViaAPI || submitter.Submission != s.ID ||
+		!submitter.Submitted.Equal(s.Submitted) {
+		t.Errorf("claim doesn't say who submitted it: %+v", submitter)
+	}
+
+	// grant
+	s, _ = submit(GrantBID, []string{"https://example.com/sub-grant", "https://example.com/sub-accept"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Error("grant not accepted: " + s2.Reason)
+	}
+
+	// unclaim by someone not mapped: ledger rejects, no retry
+	s, _ = submit(UnclaimBID, []string{"https://example.com/sub-unclaim"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionRejected || !strings.Contains(s2.Reason, "not mapped") {
+		t.Error("bogus unclaim not rejected: " + s2.Reason)
+	}
+
+	// wrong opcode
+	s, _ = submit(UnclaimBID, []string{"https://example.com/sub-claim"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionRejected || s2.Attempts != 1 {
+		t.Error("claim assertion accepted as unclaim")
+	}
+
+	// fetch failures are retried, then rejected
+	rememberAttempts, rememberDelay := MaxFetchAttempts, RetryDelay
+	MaxFetchAttempts, RetryDelay = 2, time.Millisecond
+	defer func() { MaxFetchAttempts, RetryDelay = rememberAttempts, rememberDelay }()
+	s, _ = submit(ClaimBID, []string{"https://example.com/not-there-yet"})
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionPending || s2.Reason == "" {
+		t.Error("fetch failure not left pending with reason")
+	}
+	processSubmission(nextSubmission(t))
+	s2, _ = getSubmission(s.ID)
+	if s2.State != SubmissionRejected || s2.Attempts != 2 {
+		t.Error("fetch failure not rejected after max attempts")
+	}
+}
+
+func TestSubmissionJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blueskid")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := dir + "/journal.jsonl"
+
+	err = OpenSubmissionJournal(path)
+	if err != nil {
+		t.Error("open: " + err.Error())
+	}
+	pending, _ := submit(ClaimBID, []string{"https://example.com/journal-1"})
+	_ = nextSubmission(t)
+	done, _ := submit(GrantBID, []string{"https://example.com/journal-2", "https://example.com/journal-3"})
+	_ = nextSubmission(t)
+	submissionsLock.Lock()
+	submissions[done.ID].State = SubmissionRejected
+	_ = journal(submissions[done.ID])
+	submissionsLock.Unlock()
+
+	// simulate restart
+	_ = submissionJournal.Close()
+	submissionJournal = nil
+	delete(submissions, pending.ID)
+	delete(submissions, done.ID)
+
+	err = OpenSubmissionJournal(path)
+	if err != nil {
+		t.Error("reopen: " + err.Error())
+	}
+	defer func() {
+		_ = submissionJournal.Close()
+		submissionJournal = nil
+	}()
+	s, ok := getSubmission(pending.ID)
+	if !ok || s.State != SubmissionPending || s.Posts[0] != "https://example.com/journal-1" {
+		t.Error("pending submission not restored")
+	}
+	s, ok = getSubmission(done.ID)
+	if !ok || s.State != SubmissionRejected || len(s.Posts) != 2 {
+		t.Error("rejected submission not restored")
+	}
+	if nextSubmission(t) != pending.ID {
+		t.Error("pending submission not re-queued")
+	}
+}
+
+func TestSubmissionHandlers(t *testing.T) {
+	w := httptest.NewRecorder()
+	ClaimBIDHandler(w, httptest.NewRequest("POST", "/claim-bid", strings.NewReader(`{"Post": "https://example.com/handler"}`)))
+	if w.Code != 202 {
+		t.Error("claim-bid not accepted: " + w.Body.String())
+	}
+	var s Submission
+	err := json.Unmarshal(w.Body.Bytes(), &s)
+	if err != nil {
+		t.Error("bad JSON: " + err.Error())
+	}
+	if w.Header().Get("Location") != "/submissions/"+s.ID {
+		t.Error("bad Location header")
+	}
+	_ = nextSubmission(t)
+
+	w = httptest.NewRecorder()
+	SubmissionHandler(w, httptest.NewRequest("GET", "/submissions/"+s.ID, nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), SubmissionPending) {
+		t.Error("can't get submission: " + w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	SubmissionHandler(w, httptest.NewRequest("GET", "/submissions/nope", nil))
+	if w.Code != 404 {
+		t.Error("found nonexistent submission")
+	}
+
+	w = httptest.NewRecorder()
+	GrantBIDHandler(w, httptest.NewRequest("POST", "/grant-bid", strings.NewReader(`{"GrantPost": "https://example.com/g"}`)))
+	if w.Code != 400 {
+		t.Error("accepted grant with missing accept post")
+	}
+}
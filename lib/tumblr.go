@@ -3,8 +3,6 @@ package blueskidgo
 import (
 	"errors"
 	"html"
-	"io"
-	"net/http"
 	"strings"
 )
 
@@ -15,12 +13,7 @@ func assertionFromTumblr (url string, fieldCount int) (assertionFields []string,
 		return
 	}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return
-	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
+	bodyBytes, err := fetchURL(url, nil)
 	if err != nil {
 		return
 	}
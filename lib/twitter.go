@@ -3,7 +3,6 @@ package blueskidgo
 import (
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
 	"os"
 	"regexp"
@@ -87,26 +86,12 @@ func fetchTweet(url string) (*tweet, error) {
 
 	query := "https://api.twitter.com/2/tweets/" + trailer + "?expansions=author_id&tweet.fields=author_id"
 
-	req, err := http.NewRequest("GET", query, nil)
-	if err != nil {
-		return nil, errors.New("Failed to create request: " + err.Error())
-	}
 	token := os.Getenv("TWITTER_BEARER_TOKEN")
 	if token == "" {
 		return nil, errors.New("TWITTER_BEARER_TOKEN not set in environment")
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := fetchURL(query, http.Header{"Authorization": {"Bearer " + token}})
 	if err != nil {
-		return nil, errors.New("GET failed: " + err.Error())
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err == nil {
-		_ = resp.Body.Close()
-	} else {
 		return nil, err
 	}
 
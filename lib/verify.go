@@ -0,0 +1,138 @@
+package blueskidgo
+
+// Dry runs. /verify-claim and /verify-grant take the same requests as /claim-bid and /grant-bid, and go through
+//  the same steps, fetching the posts, checking the assertions, and checking the record against the ledger, but
+//  report how each step went instead of appending anything.
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type verifyCheck struct {
+	Check  string
+	Passed bool
+	Detail string `json:",omitempty"`
+}
+
+// verifyResponse lists the checks in the order they were made; after one fails, no more are made. Record is what
+// would have gone in the ledger.
+type verifyResponse struct {
+	Passed bool
+	Checks []verifyCheck
+	Record *LedgerRecord `json:",omitempty"`
+}
+
+// add records how a check went, and returns whether it passed
+func (v *verifyResponse) add(check string, err error, detail string) bool {
+	c := verifyCheck{Check: check, Passed: err == nil, Detail: detail}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	v.Checks = append(v.Checks, c)
+	return err == nil
+}
+
+// dryRun makes the checks appendToLedger would, and returns the record as it would have been appended
+func (s *ledgerStore) dryRun(record *LedgerRecord) (*LedgerRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	txn, err := s.begin(record, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	err = txn.validate(s)
+	if err != nil {
+		return nil, err
+	}
+	next := txn.next
+	return &next, nil
+}
+
+func verifyClaim(s *ledgerStore, post string) *verifyResponse {
+	v := &verifyResponse{Checks: []verifyCheck{}}
+	fields, pid, err := fetchAssertion(post, 2)
+	if !v.add("fetch claim post", err, "posted by "+pid) {
+		return v
+	}
+	record, err := bidRecordFromAssertion(ClaimBID, "C", post, fields, pid)
+	if !v.add("claim assertion", err, "") {
+		return v
+	}
+	v.check(s, record)
+	return v
+}
+
+// verifyGrant checks a Grant or Transfer pair, going by what the assertions say they are
+func verifyGrant(s *ledgerStore, grantPost string, acceptPost string) *verifyResponse {
+	v := &verifyResponse{Checks: []verifyCheck{}}
+	gFields, gPID, err := fetchAssertion(grantPost, 6)
+	if !v.add("fetch grant post", err, "posted by "+gPID) {
+		return v
+	}
+	aFields, aPID, err := fetchAssertion(acceptPost, 6)
+	if !v.add("fetch accept post", err, "posted by "+aPID) {
+		return v
+	}
+	var recType recordType = GrantBID
+	granter, err := checkPairedAssertions(gFields, gPID, aFields, aPID)
+	if err == nil {
+		recType = granter.opcode.recType
+	}
+	record, err := grantRecordFromAssertions(recType, grantPost, gFields, gPID, acceptPost, aFields, aPID)
+	if !v.add("grant and accept assertions", err, "") {
+		return v
+	}
+	v.check(s, record)
+	return v
+}
+
+// check is the last step, checking record against the ledger in s
+func (v *verifyResponse) check(s *ledgerStore, record *LedgerRecord) {
+	appended, err := s.dryRun(record)
+	if v.add("ledger preconditions", err, "") {
+		v.Passed = true
+		v.Record = appended
+	}
+}
+
+// VerifyClaimHandler serves /verify-claim, which takes the same request as /claim-bid
+func VerifyClaimHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req bidRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Post == "" {
+		http.Error(w, "Missing field 'Post'", http.StatusBadRequest)
+		return
+	}
+	respJSON, err := json.MarshalIndent(verifyClaim(storeFor(httpRequest), req.Post), "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// VerifyGrantHandler serves /verify-grant, which takes the same request as /grant-bid
+func VerifyGrantHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req grantRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.GrantPost == "" || req.AcceptPost == "" {
+		http.Error(w, "Missing fields in JSON request", http.StatusBadRequest)
+		return
+	}
+	respJSON, err := json.MarshalIndent(verifyGrant(storeFor(httpRequest), req.GrantPost, req.AcceptPost), "", " ")
+	writeJson(w, respJSON, err)
+}
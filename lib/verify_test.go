@@ -0,0 +1,88 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	defer freshLedger()()
+	fetchAssertion = fakeFetch
+	defer func() { fetchAssertion = fetchAssertionFromPost }()
+
+	bid := uint64(0xf047)
+	fakePosts["https://example.com/v-claim"] = fakePost{"twitter.com@v1", bidAssertion("C", bid)}
+	fakePosts["https://example.com/v-unclaim"] = fakePost{"twitter.com@v1", bidAssertion("U", bid)}
+	g, a, _ := generateGrantAssertions(bid, "twitter.com@v1", "reddit.com@v2")
+	fakePosts["https://example.com/v-grant"] = fakePost{"twitter.com@v1", g}
+	fakePosts["https://example.com/v-accept"] = fakePost{"reddit.com@v2", a}
+	fakePosts["https://example.com/v-wrong-accepter"] = fakePost{"reddit.com@v3", a}
+
+	verify := func(handler func(w *httptest.ResponseRecorder), failed string) verifyResponse {
+		w := httptest.NewRecorder()
+		handler(w)
+		var resp verifyResponse
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		last := resp.Checks[len(resp.Checks)-1]
+		if failed == "" && (!resp.Passed || !last.Passed || resp.Record == nil) {
+			t.Error("should have passed: " + w.Body.String())
+		}
+		if failed != "" && (resp.Passed || last.Passed || last.Check != failed || resp.Record != nil) {
+			t.Errorf("should have failed %s: %s", failed, w.Body.String())
+		}
+		return resp
+	}
+	claim := func(post string) func(w *httptest.ResponseRecorder) {
+		return func(w *httptest.ResponseRecorder) {
+			VerifyClaimHandler(w, httptest.NewRequest("POST", "/verify-claim", strings.NewReader(`{"Post":"`+post+`"}`)))
+		}
+	}
+	grant := func(grantPost string, acceptPost string) func(w *httptest.ResponseRecorder) {
+		return func(w *httptest.ResponseRecorder) {
+			VerifyGrantHandler(w, httptest.NewRequest("POST", "/verify-grant",
+				strings.NewReader(`{"GrantPost":"`+grantPost+`","AcceptPost":"`+acceptPost+`"}`)))
+		}
+	}
+
+	verify(claim("https://example.com/missing"), "fetch claim post")
+	verify(claim("https://example.com/v-unclaim"), "claim assertion")
+	resp := verify(claim("https://example.com/v-claim"), "")
+	if len(resp.Checks) != 3 || resp.Record.PIDs[0] != "twitter.com@v1" || resp.Record.BID != FormatBID(bid) {
+		t.Errorf("claim report: %+v", resp)
+	}
+	verify(grant("https://example.com/v-grant", "https://example.com/v-accept"), "ledger preconditions")
+	if len(theStore.recordsSoFar()) != 0 {
+		t.Fatal("dry run appended")
+	}
+
+	_ = appendToLedger(&LedgerRecord{RecType: ClaimBID, BID: FormatBID(bid), PIDs: []string{"twitter.com@v1"}})
+	verify(claim("https://example.com/v-claim"), "ledger preconditions")
+	verify(grant("https://example.com/v-grant", "https://example.com/missing"), "fetch accept post")
+	verify(grant("https://example.com/v-grant", "https://example.com/v-wrong-accepter"), "grant and accept assertions")
+	resp = verify(grant("https://example.com/v-grant", "https://example.com/v-accept"), "")
+	if resp.Record.Sequence != 1 || resp.Record.Hash == "" {
+		t.Errorf("grant report: %+v", resp.Record)
+	}
+	if len(theStore.recordsSoFar()) != 1 || theStore.isMapped(FormatBID(bid), "reddit.com@v2") {
+		t.Error("dry run changed the ledger")
+	}
+
+	// a Transfer pair is checked as a Transfer
+	tg, ta, _ := generatePairedAssertions("T", "TA", bid, "twitter.com@v1", "reddit.com@v4")
+	fakePosts["https://example.com/v-transfer"] = fakePost{"twitter.com@v1", tg}
+	fakePosts["https://example.com/v-transfer-accept"] = fakePost{"reddit.com@v4", ta}
+	resp = verify(grant("https://example.com/v-transfer", "https://example.com/v-transfer-accept"), "")
+	if resp.Record.RecType != TransferBID {
+		t.Errorf("transfer report: %+v", resp.Record)
+	}
+
+	// the key is still good for the real thing
+	s, _ := submit(GrantBID, []string{"https://example.com/v-grant", "https://example.com/v-accept"})
+	processSubmission(nextSubmission(t))
+	s2, _ := getSubmission(s.ID)
+	if s2.State != SubmissionAccepted {
+		t.Error("grant after dry run: " + s2.Reason)
+	}
+}
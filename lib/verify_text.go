@@ -0,0 +1,175 @@
+package blueskidgo
+
+// Checking assertion text directly, rather than fetching it from a post: for tests, and for text from elsewhere,
+//  such as an archive of a post that's gone. The caller says who posted each text. Nothing is checked against the
+//  ledger.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// AssertionFields is an assertion broken out into its fields. For a two-field assertion, such as a Claim, only
+// Opcode and BID are present.
+type AssertionFields struct {
+	Opcode         string
+	BID            string `json:",omitempty"` // in canonical form, if it parses
+	Nonce          string `json:",omitempty"`
+	Key            string `json:",omitempty"`
+	KeyFingerprint string `json:",omitempty"` // SHA256: and the unpadded base64 SHA-256 of the key
+	Counterparty   string `json:",omitempty"`
+	SignatureValid bool
+}
+
+// GrantTextReport is how a Grant or Transfer pair's text checked out. Grant or Accept is missing if no assertion
+// could be found in its text.
+type GrantTextReport struct {
+	Passed  bool
+	Problem string `json:",omitempty"`
+	Grant   *AssertionFields
+	Accept  *AssertionFields
+}
+
+// ClaimTextReport is how a Claim's text checked out
+type ClaimTextReport struct {
+	Passed  bool
+	Problem string `json:",omitempty"`
+	Claim   *AssertionFields
+}
+
+type grantTextRequest struct {
+	GrantText  string
+	Granter    string
+	AcceptText string
+	Accepter   string
+}
+
+type claimTextRequest struct {
+	Text string
+	PID  string
+}
+
+// keyFingerprint is "" if key doesn't parse
+func keyFingerprint(key string) string {
+	if _, err := StringToKey(key); err != nil {
+		return ""
+	}
+	der, _ := base64.StdEncoding.DecodeString(key)
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// assertionFields breaks out fields found by findBlueskidAssertion. The signature of a six-field assertion is
+// checked the way checkGrantAssertion checks it, over the nonce.
+func assertionFields(fields []string) *AssertionFields {
+	a := &AssertionFields{Opcode: fields[Opcode]}
+	if bid, err := ParseBID(fields[BID]); err == nil {
+		a.BID = FormatBID(bid)
+	}
+	if len(fields) < 6 {
+		return a
+	}
+	a.Nonce = fields[ClaimNonce]
+	a.Key = fields[ClaimKey]
+	a.KeyFingerprint = keyFingerprint(a.Key)
+	a.Counterparty = fields[ClaimCounterparty]
+	key, err := StringToKey(a.Key)
+	sig, sigErr := base64.StdEncoding.DecodeString(fields[ClaimSig])
+	nonce, nonceErr := base64.StdEncoding.DecodeString(a.Nonce)
+	if err == nil && sigErr == nil && nonceErr == nil {
+		a.SignatureValid = ed25519.Verify(key, nonce, sig)
+	}
+	return a
+}
+
+// VerifyGrantText checks the text of a Grant or Transfer pair, posted by granter and accepter respectively
+func VerifyGrantText(grantText string, granter string, acceptText string, accepter string) *GrantTextReport {
+	report := &GrantTextReport{}
+	gFields, gErr := findBlueskidAssertion(grantText, 6)
+	if gErr == nil {
+		report.Grant = assertionFields(gFields)
+	}
+	aFields, aErr := findBlueskidAssertion(acceptText, 6)
+	if aErr == nil {
+		report.Accept = assertionFields(aFields)
+	}
+	if gErr != nil {
+		report.Problem = "grant text: " + gErr.Error()
+		return report
+	}
+	if aErr != nil {
+		report.Problem = "accept text: " + aErr.Error()
+		return report
+	}
+	_, err := checkGrantAssertionPair(gFields, granter, aFields, accepter)
+	if err != nil {
+		report.Problem = err.Error()
+		return report
+	}
+	report.Passed = true
+	return report
+}
+
+// VerifyClaimText checks the text of a Claim posted by pid
+func VerifyClaimText(text string, pid string) *ClaimTextReport {
+	report := &ClaimTextReport{}
+	fields, err := findBlueskidAssertion(text, 2)
+	if err != nil {
+		report.Problem = err.Error()
+		return report
+	}
+	report.Claim = assertionFields(fields)
+	_, err = bidRecordFromAssertion(ClaimBID, "C", "", fields, pid)
+	if err == nil {
+		_, err = NormalizePID(pid)
+	}
+	if err != nil {
+		report.Problem = err.Error()
+		return report
+	}
+	report.Passed = true
+	return report
+}
+
+// VerifyGrantTextHandler serves /verify-grant-text
+func VerifyGrantTextHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req grantTextRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.GrantText == "" || req.Granter == "" || req.AcceptText == "" || req.Accepter == "" {
+		http.Error(w, "Missing fields in JSON request", http.StatusBadRequest)
+		return
+	}
+	respJSON, err := json.MarshalIndent(VerifyGrantText(req.GrantText, req.Granter, req.AcceptText, req.Accepter), "", " ")
+	writeJson(w, respJSON, err)
+}
+
+// VerifyClaimTextHandler serves /verify-claim-text
+func VerifyClaimTextHandler(w http.ResponseWriter, httpRequest *http.Request) {
+	body := openPost(w, httpRequest)
+	if body == nil {
+		return
+	}
+	var req claimTextRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		http.Error(w, "Can't parse JSON request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Text == "" || req.PID == "" {
+		http.Error(w, "Missing fields in JSON request", http.StatusBadRequest)
+		return
+	}
+	respJSON, err := json.MarshalIndent(VerifyClaimText(req.Text, req.PID), "", " ")
+	writeJson(w, respJSON, err)
+}
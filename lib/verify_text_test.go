@@ -0,0 +1,85 @@
+package blueskidgo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyGrantText(t *testing.T) {
+	g, a, _ := generateGrantAssertions(0xf048, "twitter.com@vt1", "reddit.com@vt2")
+	report := VerifyGrantText("archived: "+g, "Twitter.com@VT1", a, "reddit.com@vt2")
+	if !report.Passed || report.Problem != "" {
+		t.Fatal("good pair failed: " + report.Problem)
+	}
+	gFields, _ := findBlueskidAssertion(g, 6)
+	grant := report.Grant
+	if grant.Opcode != "G" || grant.BID != FormatBID(0xf048) || grant.Nonce != gFields[ClaimNonce] || grant.Key != gFields[ClaimKey] ||
+		grant.Counterparty != "reddit.com@vt2" || !grant.SignatureValid || !strings.HasPrefix(grant.KeyFingerprint, "SHA256:") {
+		t.Errorf("grant fields: %+v", grant)
+	}
+	if report.Accept.Opcode != "A" || report.Accept.KeyFingerprint != grant.KeyFingerprint || report.Accept.Counterparty != "twitter.com@vt1" {
+		t.Errorf("accept fields: %+v", report.Accept)
+	}
+
+	report = VerifyGrantText(g, "twitter.com@vt1", a, "reddit.com@someone-else")
+	if report.Passed || !strings.Contains(report.Problem, "does not identify accepter") || report.Grant == nil || report.Accept == nil {
+		t.Errorf("wrong accepter: %+v", report)
+	}
+	report = VerifyGrantText(g, "twitter.com@vt1", "no assertion here", "reddit.com@vt2")
+	if report.Passed || report.Accept != nil || report.Grant == nil || !strings.HasPrefix(report.Problem, "accept text") {
+		t.Errorf("missing accept: %+v", report)
+	}
+
+	// a bad signature is reported as such, and fails the pair
+	fields := append([]string(nil), gFields...)
+	other, _, _ := generateGrantAssertions(0xf048, "twitter.com@vt1", "reddit.com@vt2")
+	otherFields, _ := findBlueskidAssertion(other, 6)
+	fields[ClaimSig] = otherFields[ClaimSig]
+	report = VerifyGrantText(assertionFromFields(fields...), "twitter.com@vt1", a, "reddit.com@vt2")
+	if report.Passed || report.Grant.SignatureValid || !report.Accept.SignatureValid {
+		t.Errorf("forged signature: %+v %+v", report, report.Grant)
+	}
+}
+
+func TestVerifyClaimText(t *testing.T) {
+	report := VerifyClaimText("mine: "+bidAssertion("C", 0xf049), "twitter.com@vt3")
+	if !report.Passed || report.Claim.Opcode != "C" || report.Claim.BID != FormatBID(0xf049) || report.Claim.Key != "" {
+		t.Errorf("good claim: %+v %+v", report, report.Claim)
+	}
+	report = VerifyClaimText(bidAssertion("U", 0xf049), "twitter.com@vt3")
+	if report.Passed || report.Claim == nil {
+		t.Errorf("unclaim passed as claim: %+v", report)
+	}
+	report = VerifyClaimText(bidAssertion("C", 0xf049), "no-provider")
+	if report.Passed {
+		t.Error("bad PID passed")
+	}
+}
+
+func TestVerifyTextHandlers(t *testing.T) {
+	g, a, _ := generateGrantAssertions(0xf04a, "twitter.com@vt4", "reddit.com@vt5")
+	body, _ := json.Marshal(&grantTextRequest{GrantText: g, Granter: "twitter.com@vt4", AcceptText: a, Accepter: "reddit.com@vt5"})
+	w := httptest.NewRecorder()
+	VerifyGrantTextHandler(w, httptest.NewRequest("POST", "/verify-grant-text", strings.NewReader(string(body))))
+	var report GrantTextReport
+	_ = json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != 200 || !report.Passed || !report.Grant.SignatureValid {
+		t.Error("verify-grant-text: " + w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	VerifyGrantTextHandler(w, httptest.NewRequest("POST", "/verify-grant-text", strings.NewReader(`{"GrantText":"x"}`)))
+	if w.Code != 400 {
+		t.Error("verify-grant-text took missing fields")
+	}
+
+	body, _ = json.Marshal(&claimTextRequest{Text: bidAssertion("C", 0xf04a), PID: "twitter.com@vt4"})
+	w = httptest.NewRecorder()
+	VerifyClaimTextHandler(w, httptest.NewRequest("POST", "/verify-claim-text", strings.NewReader(string(body))))
+	var claim ClaimTextReport
+	_ = json.Unmarshal(w.Body.Bytes(), &claim)
+	if w.Code != 200 || !claim.Passed {
+		t.Error("verify-claim-text: " + w.Body.String())
+	}
+}